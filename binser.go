@@ -0,0 +1,387 @@
+package logfu
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// MsgpackSerializerFac is a factory for MessagePack Serializers
+func MsgpackSerializerFac() (Serializer, error) {
+	return SerializerFunc(MsgpackSerialize), nil
+}
+
+// MsgpackSerialize writes the keyvals as a single MessagePack map in
+// keyval order. time.Time values use the MessagePack timestamp
+// extension. Use github.com/msample/logfu/lib/lfuread to read them
+// back.
+//
+// Both binary serializers write nil, bools, ints, uints, floats,
+// strings and []byte as their native types, slices and maps as
+// arrays and maps, errors, fmt.Stringers and encoding.TextMarshalers
+// (including time.Duration) as strings, and anything else as it would
+// decode from its encoding/json form.
+func MsgpackSerialize(w io.Writer, kvs []interface{}) error {
+	return binSerialize(w, kvs, msgpackEnc{})
+}
+
+// CBORSerializerFac is a factory for CBOR Serializers
+func CBORSerializerFac() (Serializer, error) {
+	return SerializerFunc(CBORSerialize), nil
+}
+
+// CBORSerialize writes the keyvals as a single CBOR (RFC 8949) map
+// in keyval order. time.Time values are tag 0 RFC 3339 strings. See
+// MsgpackSerialize for how other values are encoded.
+func CBORSerialize(w io.Writer, kvs []interface{}) error {
+	return binSerialize(w, kvs, cborEnc{})
+}
+
+// binEnc encodes the data model shared by MessagePack and CBOR
+type binEnc interface {
+	appendNil(dst []byte) []byte
+	appendBool(dst []byte, b bool) []byte
+	appendInt(dst []byte, i int64) []byte
+	appendUint(dst []byte, u uint64) []byte
+	appendFloat32(dst []byte, f float32) []byte
+	appendFloat64(dst []byte, f float64) []byte
+	appendString(dst []byte, s string) []byte
+	appendBytes(dst []byte, b []byte) []byte
+	appendTime(dst []byte, t time.Time) []byte
+	appendArrayHead(dst []byte, n int) []byte
+	appendMapHead(dst []byte, n int) []byte
+}
+
+// maxBinDepth bounds nesting of slices and maps, guarding against
+// cycles
+const maxBinDepth = 32
+
+func binSerialize(w io.Writer, kvs []interface{}, e binEnc) error {
+	bp := getBuf()
+	defer putBuf(bp)
+
+	b := e.appendMapHead((*bp)[:0], (len(kvs)+1)/2)
+	var err error
+	for i := 0; i < len(kvs); i += 2 {
+		b = e.appendString(b, keyString(kvs[i]))
+		if i+1 < len(kvs) {
+			if b, err = appendBinValue(e, b, kvs[i+1], 0); err != nil {
+				return err
+			}
+		} else {
+			b = e.appendString(b, missingValue)
+		}
+	}
+	*bp = b
+	_, err = w.Write(b)
+	return err
+}
+
+func appendBinValue(e binEnc, dst []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxBinDepth {
+		return dst, fmt.Errorf("value nested more than %v deep", maxBinDepth)
+	}
+	switch x := v.(type) {
+	case nil:
+		return e.appendNil(dst), nil
+	case string:
+		return e.appendString(dst, x), nil
+	case bool:
+		return e.appendBool(dst, x), nil
+	case int:
+		return e.appendInt(dst, int64(x)), nil
+	case int8:
+		return e.appendInt(dst, int64(x)), nil
+	case int16:
+		return e.appendInt(dst, int64(x)), nil
+	case int32:
+		return e.appendInt(dst, int64(x)), nil
+	case int64:
+		return e.appendInt(dst, x), nil
+	case uint:
+		return e.appendUint(dst, uint64(x)), nil
+	case uint8:
+		return e.appendUint(dst, uint64(x)), nil
+	case uint16:
+		return e.appendUint(dst, uint64(x)), nil
+	case uint32:
+		return e.appendUint(dst, uint64(x)), nil
+	case uint64:
+		return e.appendUint(dst, x), nil
+	case float32:
+		return e.appendFloat32(dst, x), nil
+	case float64:
+		return e.appendFloat64(dst, x), nil
+	case []byte:
+		return e.appendBytes(dst, x), nil
+	case time.Time:
+		return e.appendTime(dst, x), nil
+	case time.Duration:
+		return e.appendString(dst, x.String()), nil
+	case error:
+		return e.appendString(dst, safeError(x)), nil
+	case fmt.Stringer:
+		return e.appendString(dst, safeString(x)), nil
+	case encoding.TextMarshaler:
+		if isNilPtr(x) {
+			return e.appendNil(dst), nil
+		}
+		b, err := x.MarshalText()
+		if err != nil {
+			return dst, err
+		}
+		return e.appendString(dst, string(b)), nil
+	case []interface{}:
+		var err error
+		dst = e.appendArrayHead(dst, len(x))
+		for _, c := range x {
+			if dst, err = appendBinValue(e, dst, c, depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case map[string]interface{}:
+		var err error
+		dst = e.appendMapHead(dst, len(x))
+		for k, c := range x {
+			dst = e.appendString(dst, k)
+			if dst, err = appendBinValue(e, dst, c, depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		var err error
+		dst = e.appendArrayHead(dst, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if dst, err = appendBinValue(e, dst, rv.Index(i).Interface(), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		var err error
+		dst = e.appendMapHead(dst, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			dst = e.appendString(dst, keyString(iter.Key().Interface()))
+			if dst, err = appendBinValue(e, dst, iter.Value().Interface(), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	// structs, pointers etc. as their JSON form decodes
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	var g interface{}
+	if err := json.Unmarshal(b, &g); err != nil {
+		return dst, err
+	}
+	return appendBinValue(e, dst, g, depth+1)
+}
+
+// MessagePack encoding, see https://github.com/msgpack/msgpack/blob/master/spec.md
+type msgpackEnc struct{}
+
+func (msgpackEnc) appendNil(dst []byte) []byte {
+	return append(dst, 0xc0)
+}
+
+func (msgpackEnc) appendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, 0xc3)
+	}
+	return append(dst, 0xc2)
+}
+
+func (o msgpackEnc) appendInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return o.appendUint(dst, uint64(i))
+	case i >= -32:
+		return append(dst, byte(i))
+	case i >= math.MinInt8:
+		return append(dst, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(i))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(i))
+}
+
+func (msgpackEnc) appendUint(dst []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(dst, byte(u))
+	case u <= math.MaxUint8:
+		return append(dst, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xce), uint32(u))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xcf), u)
+}
+
+func (msgpackEnc) appendFloat32(dst []byte, f float32) []byte {
+	return binary.BigEndian.AppendUint32(append(dst, 0xca), math.Float32bits(f))
+}
+
+func (msgpackEnc) appendFloat64(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(f))
+}
+
+func (msgpackEnc) appendString(dst []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xda), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xdb), uint32(n))
+	}
+	return append(dst, s...)
+}
+
+func (msgpackEnc) appendBytes(dst []byte, b []byte) []byte {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xc5), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xc6), uint32(n))
+	}
+	return append(dst, b...)
+}
+
+// appendTime uses the timestamp extension (type -1) in its 32, 64
+// or 96 bit form
+func (msgpackEnc) appendTime(dst []byte, t time.Time) []byte {
+	sec, nsec := t.Unix(), uint64(t.Nanosecond())
+	switch {
+	case sec >= 0 && sec <= math.MaxUint32 && nsec == 0:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd6, 0xff), uint32(sec))
+	case sec >= 0 && sec < 1<<34:
+		return binary.BigEndian.AppendUint64(append(dst, 0xd7, 0xff), nsec<<34|uint64(sec))
+	}
+	dst = binary.BigEndian.AppendUint32(append(dst, 0xc7, 12, 0xff), uint32(nsec))
+	return binary.BigEndian.AppendUint64(dst, uint64(sec))
+}
+
+func (msgpackEnc) appendArrayHead(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xdc), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, 0xdd), uint32(n))
+}
+
+func (msgpackEnc) appendMapHead(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xde), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(dst, 0xdf), uint32(n))
+}
+
+// CBOR encoding, see RFC 8949
+type cborEnc struct{}
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+)
+
+// cborHead appends a major type and argument
+func cborHead(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, major|27), n)
+}
+
+func (cborEnc) appendNil(dst []byte) []byte {
+	return append(dst, 0xf6)
+}
+
+func (cborEnc) appendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, 0xf5)
+	}
+	return append(dst, 0xf4)
+}
+
+func (cborEnc) appendInt(dst []byte, i int64) []byte {
+	if i >= 0 {
+		return cborHead(dst, cborUint, uint64(i))
+	}
+	return cborHead(dst, cborNegInt, uint64(-1-i))
+}
+
+func (cborEnc) appendUint(dst []byte, u uint64) []byte {
+	return cborHead(dst, cborUint, u)
+}
+
+func (cborEnc) appendFloat32(dst []byte, f float32) []byte {
+	return binary.BigEndian.AppendUint32(append(dst, 0xfa), math.Float32bits(f))
+}
+
+func (cborEnc) appendFloat64(dst []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(dst, 0xfb), math.Float64bits(f))
+}
+
+func (cborEnc) appendString(dst []byte, s string) []byte {
+	return append(cborHead(dst, cborText, uint64(len(s))), s...)
+}
+
+func (cborEnc) appendBytes(dst []byte, b []byte) []byte {
+	return append(cborHead(dst, cborBytes, uint64(len(b))), b...)
+}
+
+// appendTime uses tag 0, a standard date/time string
+func (o cborEnc) appendTime(dst []byte, t time.Time) []byte {
+	return o.appendString(cborHead(dst, cborTag, 0), t.Format(time.RFC3339Nano))
+}
+
+func (cborEnc) appendArrayHead(dst []byte, n int) []byte {
+	return cborHead(dst, cborArray, uint64(n))
+}
+
+func (cborEnc) appendMapHead(dst []byte, n int) []byte {
+	return cborHead(dst, cborMap, uint64(n))
+}
@@ -0,0 +1,353 @@
+package logfu
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CEFMapping is the default mapping of keyval keys to ArcSight CEF
+// extension keys used by CEFSerializerFac.
+var CEFMapping = map[string]string{
+	"ts":       "rt",
+	"user":     "suser",
+	"src_ip":   "src",
+	"src_port": "spt",
+	"dst_ip":   "dst",
+	"dst_port": "dpt",
+	"host":     "dhost",
+	"action":   "act",
+	"outcome":  "outcome",
+	"reason":   "reason",
+	"method":   "requestMethod",
+	"url":      "request",
+	"proto":    "proto",
+	"file":     "fname",
+	"app":      "app",
+}
+
+// LEEFMapping is the default mapping of keyval keys to QRadar LEEF
+// attribute keys used by LEEFSerializerFac.
+var LEEFMapping = map[string]string{
+	"ts":       "devTime",
+	"user":     "usrName",
+	"src_ip":   "src",
+	"src_port": "srcPort",
+	"dst_ip":   "dst",
+	"dst_port": "dstPort",
+	"proto":    "proto",
+	"action":   "cat",
+	"url":      "url",
+	"method":   "method",
+}
+
+// secLevels maps level names to 0-10 CEF/LEEF severities
+var secLevels = map[string]int{
+	"debug": 1,
+	"info":  3,
+	"audit": 5,
+	"warn":  6,
+	"error": 8,
+}
+
+// CEFOpts configures the Serializer returned by CEFSerializerFac.
+type CEFOpts struct {
+	// Vendor, Product and Version fill the CEF device header
+	// fields.
+	Vendor  string
+	Product string
+	Version string
+
+	// SignatureKey's value is the Signature ID (Device Event Class
+	// ID), defaulting to "event". Signature is used for records
+	// without it.
+	SignatureKey string
+	Signature    string
+
+	// NameKey's value is the event Name. Defaults to "msg".
+	NameKey string
+
+	// SeverityKey's value, if present, is the 0-10 severity. Else
+	// the severity is derived from LevelKey's value. They default
+	// to "severity" and LevelKey.
+	SeverityKey string
+	LevelKey    string
+
+	// Mapping overrides and extends CEFMapping. Map a key to ""
+	// to leave it unmapped.
+	Mapping map[string]string
+}
+
+// CEFSerializerFac returns a SerializerFac for ArcSight Common Event
+// Format lines, e.g. for AUDIT records sent to the syslog writers:
+//
+//	CEF:0|Acme|Billing|1.2|login|user logged in|5|suser=bob src=10.0.0.1
+//
+// Header fields have | and \ escaped, extension values have = and \
+// escaped and newlines written as \n. Extension keys are renamed per
+// the mapping and stripped of characters CEF doesn't allow. time.Time
+// values are written as milliseconds since the epoch.
+func CEFSerializerFac(opts CEFOpts) func() (Serializer, error) {
+	if opts.SignatureKey == "" {
+		opts.SignatureKey = "event"
+	}
+	if opts.Signature == "" {
+		opts.Signature = "0"
+	}
+	if opts.NameKey == "" {
+		opts.NameKey = "msg"
+	}
+	if opts.SeverityKey == "" {
+		opts.SeverityKey = "severity"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	m := mergeMapping(CEFMapping, opts.Mapping)
+	return func() (Serializer, error) {
+		return SerializerFunc(func(w io.Writer, keyvals []interface{}) error {
+			sig, name, sev, ext := secFields(keyvals, opts.SignatureKey, opts.NameKey,
+				opts.SeverityKey, opts.LevelKey)
+			if sig == "" {
+				sig = opts.Signature
+			}
+
+			bp := getBuf()
+			defer putBuf(bp)
+			b := append((*bp)[:0], "CEF:0|"...)
+			for _, f := range []string{opts.Vendor, opts.Product, opts.Version, sig, name} {
+				b = appendSecHeader(b, f)
+				b = append(b, '|')
+			}
+			b = strconv.AppendInt(b, int64(sev), 10)
+			b = append(b, '|')
+			sep := false
+			for i := 0; i < len(ext); i += 2 {
+				k := cefKey(keyString(ext[i]), m)
+				if k == "" {
+					continue
+				}
+				if sep {
+					b = append(b, ' ')
+				}
+				sep = true
+				b = append(b, k...)
+				b = append(b, '=')
+				b = appendCEFValue(b, secValue(ext[i+1]))
+			}
+			b = append(b, '\n')
+			*bp = b
+			_, err := w.Write(b)
+			return err
+		}), nil
+	}
+}
+
+// LEEFOpts configures the Serializer returned by LEEFSerializerFac.
+type LEEFOpts struct {
+	// Vendor, Product and Version fill the LEEF header fields.
+	Vendor  string
+	Product string
+	Version string
+
+	// EventIDKey's value is the LEEF Event ID, defaulting to
+	// "event". EventID is used for records without it.
+	EventIDKey string
+	EventID    string
+
+	// SeverityKey's value, if present, is the sev
+	// attribute. Otherwise it is derived from LevelKey's value.
+	// They default to "severity" and LevelKey.
+	SeverityKey string
+	LevelKey    string
+
+	// Delimiter separates attributes. Defaults to tab. Other
+	// delimiters are declared in the LEEF 2.0 header.
+	Delimiter rune
+
+	// Mapping overrides and extends LEEFMapping. Map a key to ""
+	// to leave it unmapped.
+	Mapping map[string]string
+}
+
+// LEEFSerializerFac returns a SerializerFac for IBM QRadar Log Event
+// Extended Format 2.0 lines:
+//
+//	LEEF:2.0|Acme|Billing|1.2|login|sev=5	usrName=bob	msg=user logged in
+//
+// Header fields have | and \ escaped. In attribute values the
+// delimiter, \ and newlines are escaped with a backslash. time.Time
+// values are written as milliseconds since the epoch, as devTime
+// allows.
+func LEEFSerializerFac(opts LEEFOpts) func() (Serializer, error) {
+	if opts.EventIDKey == "" {
+		opts.EventIDKey = "event"
+	}
+	if opts.EventID == "" {
+		opts.EventID = "0"
+	}
+	if opts.SeverityKey == "" {
+		opts.SeverityKey = "severity"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	if opts.Delimiter == 0 {
+		opts.Delimiter = '\t'
+	}
+	m := mergeMapping(LEEFMapping, opts.Mapping)
+	delim := string(opts.Delimiter)
+	return func() (Serializer, error) {
+		return SerializerFunc(func(w io.Writer, keyvals []interface{}) error {
+			id, _, sev, attrs := secFields(keyvals, opts.EventIDKey, "",
+				opts.SeverityKey, opts.LevelKey)
+			if id == "" {
+				id = opts.EventID
+			}
+
+			bp := getBuf()
+			defer putBuf(bp)
+			b := append((*bp)[:0], "LEEF:2.0|"...)
+			for _, f := range []string{opts.Vendor, opts.Product, opts.Version, id} {
+				b = appendSecHeader(b, f)
+				b = append(b, '|')
+			}
+			if opts.Delimiter != '\t' {
+				b = append(b, delim...)
+				b = append(b, '|')
+			}
+			b = append(b, "sev="...)
+			b = strconv.AppendInt(b, int64(sev), 10)
+			for i := 0; i < len(attrs); i += 2 {
+				k := keyString(attrs[i])
+				if f, ok := m[k]; ok {
+					k = f
+				}
+				b = append(b, delim...)
+				for _, r := range k {
+					if r == '=' || r == opts.Delimiter {
+						r = '_'
+					}
+					b = utf8.AppendRune(b, r)
+				}
+				b = append(b, '=')
+				b = appendLEEFValue(b, secValue(attrs[i+1]), opts.Delimiter)
+			}
+			b = append(b, '\n')
+			*bp = b
+			_, err := w.Write(b)
+			return err
+		}), nil
+	}
+}
+
+// secFields pulls the header fields out of keyvals, returning the
+// rest as paired keyvals.
+func secFields(keyvals []interface{}, idKey, nameKey, sevKey, levelKey string) (id, name string, sev int, rest []interface{}) {
+	sev = -1
+	lsev := secLevels["info"]
+	rest = make([]interface{}, 0, len(keyvals)+1)
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch k {
+		case idKey:
+			id = valueString(v)
+			continue
+		case nameKey:
+			name = valueString(v)
+			continue
+		case sevKey:
+			if f, ok := toFloat(v); ok && f >= 0 && f <= 10 {
+				sev = int(f)
+				continue
+			}
+		case levelKey:
+			if l, ok := secLevels[valueString(v)]; ok {
+				lsev = l
+			}
+			continue
+		}
+		rest = append(rest, k, v)
+	}
+	if sev < 0 {
+		sev = lsev
+	}
+	return
+}
+
+// secValue converts values to strings for CEF and LEEF
+func secValue(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return valueString(v)
+}
+
+// cefKey maps k and strips it to the alphanumerics CEF allows
+func cefKey(k string, m map[string]string) string {
+	if f, ok := m[k]; ok {
+		return f
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, k)
+}
+
+// appendSecHeader appends a CEF or LEEF header field, escaping | and
+// \ and flattening newlines to spaces.
+func appendSecHeader(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '|', '\\':
+			dst = append(dst, '\\', c)
+		case '\r', '\n':
+			dst = append(dst, ' ')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func appendCEFValue(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '=', '\\':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func appendLEEFValue(dst []byte, s string, delim rune) []byte {
+	for _, r := range s {
+		switch {
+		case r == delim && r == '\t':
+			dst = append(dst, '\\', 't')
+		case r == delim || r == '\\':
+			dst = utf8.AppendRune(append(dst, '\\'), r)
+		case r == '\n':
+			dst = append(dst, '\\', 'n')
+		case r == '\r':
+			dst = append(dst, '\\', 'r')
+		default:
+			dst = utf8.AppendRune(dst, r)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,271 @@
+package logfu
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsoleOpts configures the Serializer returned by
+// ConsoleSerializerFac.
+type ConsoleOpts struct {
+	// TimeKey, LevelKey and MsgKey name the keyvals shown in the
+	// leading columns. They default to "ts", LevelKey and "msg".
+	// If a record has no TimeKey keyval the current time is shown.
+	TimeKey  string
+	LevelKey string
+	MsgKey   string
+
+	// TimeFormat is the time.Format layout for the time
+	// column. Defaults to "15:04:05.000".
+	TimeFormat string
+
+	// MsgWidth pads the message column. Defaults to 40.
+	MsgWidth int
+
+	// Color is ColorAuto (the default), ColorAlways or ColorNever.
+	Color ColorMode
+}
+
+// ColorMode controls ANSI colors in console output
+type ColorMode int
+
+const (
+	// ColorAuto colors output to terminals unless the NO_COLOR
+	// env var is set
+	ColorAuto ColorMode = iota
+	ColorAlways
+	ColorNever
+)
+
+// ConsoleSerializerFac returns a SerializerFac for human-readable
+// output for local development:
+//
+//	10:00:00.000 ERROR could not connect        addr=db:5432 err="dial tcp: refused"
+//	    err.stack:
+//	        main.main
+//	            /src/main.go:12
+//
+// Values with newlines, such as stack traces, are written indented on
+// lines of their own after the record's first line. Use
+// Config.SetLevelKey to get level keyvals in records.
+func ConsoleSerializerFac(opts ConsoleOpts) func() (Serializer, error) {
+	if opts.TimeKey == "" {
+		opts.TimeKey = "ts"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	if opts.MsgKey == "" {
+		opts.MsgKey = "msg"
+	}
+	if opts.TimeFormat == "" {
+		opts.TimeFormat = "15:04:05.000"
+	}
+	if opts.MsgWidth <= 0 {
+		opts.MsgWidth = 40
+	}
+	return func() (Serializer, error) {
+		return &consoleSerializer{opts: opts, ttys: make(map[uintptr]bool)}, nil
+	}
+}
+
+type consoleSerializer struct {
+	opts  ConsoleOpts
+	mutex sync.Mutex
+	ttys  map[uintptr]bool // terminal check results by fd
+}
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiDim     = "\x1b[2m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiBlue    = "\x1b[34m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+)
+
+var levelColors = map[string]string{
+	"error": ansiRed,
+	"warn":  ansiYellow,
+	"info":  ansiGreen,
+	"debug": ansiBlue,
+	"audit": ansiMagenta,
+}
+
+func (o *consoleSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	color := o.useColor(w)
+	var ts, lvl, msg interface{}
+	var haveTs, haveLvl, haveMsg bool
+	var multi []int // indexes of multi-line values
+	bp := getBuf()
+	defer putBuf(bp)
+	b := (*bp)[:0]
+	var rest []byte
+
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch {
+		case k == o.opts.TimeKey && !haveTs:
+			ts, haveTs = v, true
+			continue
+		case k == o.opts.LevelKey && !haveLvl:
+			lvl, haveLvl = v, true
+			continue
+		case k == o.opts.MsgKey && !haveMsg:
+			msg, haveMsg = v, true
+			continue
+		}
+		s := valueString(v)
+		if strings.Contains(s, "\n") {
+			multi = append(multi, i)
+			continue
+		}
+		rest = append(rest, ' ')
+		if color {
+			rest = append(rest, ansiCyan...)
+		}
+		rest = append(rest, k...)
+		rest = append(rest, '=')
+		if color {
+			rest = append(rest, ansiReset...)
+		}
+		rest = appendLogfmtString(rest, s)
+	}
+
+	// time column
+	if color {
+		b = append(b, ansiDim...)
+	}
+	if t, ok := ts.(time.Time); ok {
+		b = t.AppendFormat(b, o.opts.TimeFormat)
+	} else if haveTs {
+		b = append(b, valueString(ts)...)
+	} else {
+		b = time.Now().AppendFormat(b, o.opts.TimeFormat)
+	}
+	if color {
+		b = append(b, ansiReset...)
+	}
+
+	// level column
+	b = append(b, ' ')
+	ls := ""
+	if haveLvl {
+		ls = strings.ToUpper(valueString(lvl))
+	}
+	if c := levelColors[strings.ToLower(ls)]; color && c != "" {
+		b = append(b, c...)
+		b = append(b, ls...)
+		b = append(b, ansiReset...)
+	} else {
+		b = append(b, ls...)
+	}
+	for n := len(ls); n < 5; n++ {
+		b = append(b, ' ')
+	}
+
+	// msg column
+	b = append(b, ' ')
+	ms := ""
+	if haveMsg {
+		ms = valueString(msg)
+	}
+	b = append(b, ms...)
+	if len(rest) > 0 {
+		for n := len([]rune(ms)); n < o.opts.MsgWidth; n++ {
+			b = append(b, ' ')
+		}
+		b = append(b, rest...)
+	}
+	b = append(b, '\n')
+
+	for _, i := range multi {
+		b = append(b, "    "...)
+		if color {
+			b = append(b, ansiCyan...)
+		}
+		b = append(b, keyString(keyvals[i])...)
+		b = append(b, ':')
+		if color {
+			b = append(b, ansiReset...)
+		}
+		b = append(b, '\n')
+		for _, l := range strings.Split(strings.TrimRight(valueString(keyvals[i+1]), "\n"), "\n") {
+			b = append(b, "        "...)
+			b = append(b, l...)
+			b = append(b, '\n')
+		}
+	}
+
+	*bp = b
+	_, err := w.Write(b)
+	return err
+}
+
+// useColor decides whether output to w gets ANSI colors
+func (o *consoleSerializer) useColor(w io.Writer) bool {
+	switch o.opts.Color {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	// os.File and go-kit's sync writer for files both have Fd()
+	f, ok := w.(interface{ Fd() uintptr })
+	if !ok {
+		return false
+	}
+	fd := f.Fd()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	tty, ok := o.ttys[fd]
+	if !ok {
+		tty = isTerminal(fd)
+		o.ttys[fd] = tty
+	}
+	return tty
+}
+
+// valueString converts a keyval value to a string for text formats
+func valueString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case error:
+		return safeError(x)
+	case fmt.Stringer:
+		return safeString(x)
+	}
+	return fmt.Sprint(v)
+}
+
+// appendLogfmtString appends s, quoted if logfmt requires it
+func appendLogfmtString(dst []byte, s string) []byte {
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, needsQuote) >= 0 {
+		return appendJSONString(dst, s)
+	}
+	return append(dst, s...)
+}
+
+func needsQuote(r rune) bool {
+	return r <= ' ' || r == 0x7f || r == 0xfffd
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+
+package logfu
+
+// isTerminal reports false where terminals can't be detected, so
+// ColorAuto output is plain.
+func isTerminal(fd uintptr) bool {
+	return false
+}
@@ -0,0 +1,184 @@
+package logfu
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// ECSVersion is the default ecs.version written by the ECS
+// serializer
+const ECSVersion = "8.11.0"
+
+// ECSMapping is the default mapping of keyval keys to Elastic Common
+// Schema field names used by ECSSerializerFac.
+var ECSMapping = map[string]string{
+	"ts":        "@timestamp",
+	"level":     "log.level",
+	"msg":       "message",
+	"logger":    "log.logger",
+	"err":       "error.message",
+	"err.type":  "error.type",
+	"err.stack": "error.stack_trace",
+	"service":   "service.name",
+	"version":   "service.version",
+	"env":       "service.environment",
+	"host":      "host.name",
+	"pod":       "kubernetes.pod.name",
+	"trace_id":  "trace.id",
+	"span_id":   "span.id",
+}
+
+// ECSOpts configures the Serializer returned by ECSSerializerFac.
+type ECSOpts struct {
+	// Mapping overrides and extends ECSMapping. Map a key to ""
+	// to leave it unmapped.
+	Mapping map[string]string
+
+	// UnmappedPrefix is prepended to keys without a mapping, e.g.
+	// "labels." or "myapp.". Empty by default.
+	UnmappedPrefix string
+
+	// Version is the ecs.version value. Defaults to ECSVersion.
+	Version string
+}
+
+// ECSSerializerFac returns a SerializerFac for Elastic Common Schema
+// JSON, one object per line. Keys are renamed per the mapping and
+// dotted names are written as nested objects, so "error.message"
+// becomes {"error":{"message":...}}. @timestamp is set from the
+// "@timestamp" field's time.Time value (mapped from "ts" by default)
+// or the current time, and ecs.version is always added. When keys
+// collide the last value wins.
+func ECSSerializerFac(opts ECSOpts) func() (Serializer, error) {
+	m := mergeMapping(ECSMapping, opts.Mapping)
+	if opts.Version == "" {
+		opts.Version = ECSVersion
+	}
+	return func() (Serializer, error) {
+		return SerializerFunc(func(w io.Writer, keyvals []interface{}) error {
+			return ecsSerialize(w, keyvals, m, &opts)
+		}), nil
+	}
+}
+
+// mergeMapping returns a copy of base with overrides applied, ""
+// values removing entries.
+func mergeMapping(base, overrides map[string]string) map[string]string {
+	m := make(map[string]string)
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range overrides {
+		if v == "" {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func ecsSerialize(w io.Writer, keyvals []interface{}, m map[string]string, o *ECSOpts) error {
+	root := &jsonNode{obj: true}
+	var ts interface{}
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		if f, ok := m[k]; ok {
+			k = f
+		} else {
+			k = o.UnmappedPrefix + k
+		}
+		if k == "@timestamp" {
+			ts = v
+			continue
+		}
+		root.set(k, v)
+	}
+	if t, ok := ts.(time.Time); ok {
+		ts = t.UTC()
+	} else if ts == nil {
+		ts = time.Now().UTC()
+	}
+	root.children = append([]*jsonNode{{key: "@timestamp", val: ts}}, root.children...)
+	root.set("ecs.version", o.Version)
+
+	bp := getBuf()
+	defer putBuf(bp)
+	b, err := root.appendJSON((*bp)[:0])
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	*bp = b
+	_, err = w.Write(b)
+	return err
+}
+
+// jsonNode is a JSON object tree node for writing dotted keys as
+// nested objects.
+type jsonNode struct {
+	key      string
+	val      interface{}
+	obj      bool
+	children []*jsonNode
+}
+
+func (o *jsonNode) child(key string) *jsonNode {
+	for _, c := range o.children {
+		if c.key == key {
+			return c
+		}
+	}
+	return nil
+}
+
+// set sets the value at the dotted path, replacing whatever was at
+// the path or in the way of it.
+func (o *jsonNode) set(path string, v interface{}) {
+	o.obj = true
+	n := o
+	for {
+		i := strings.IndexByte(path, '.')
+		if i <= 0 || i == len(path)-1 {
+			break
+		}
+		c := n.child(path[:i])
+		if c == nil {
+			c = &jsonNode{key: path[:i]}
+			n.children = append(n.children, c)
+		}
+		if !c.obj {
+			c.obj, c.val = true, nil
+		}
+		n, path = c, path[i+1:]
+	}
+	if c := n.child(path); c != nil {
+		c.obj, c.val, c.children = false, v, nil
+		return
+	}
+	n.children = append(n.children, &jsonNode{key: path, val: v})
+}
+
+func (o *jsonNode) appendJSON(dst []byte) ([]byte, error) {
+	if !o.obj {
+		return appendJSONValue(dst, o.val)
+	}
+	var err error
+	dst = append(dst, '{')
+	for i, c := range o.children {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, c.key)
+		dst = append(dst, ':')
+		if dst, err = c.appendJSON(dst); err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
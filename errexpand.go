@@ -0,0 +1,252 @@
+package logfu
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+
+	"github.com/msample/log2"
+)
+
+// ErrorExpandOpts configures the Filterer returned by
+// ErrorExpandFilterFac.
+type ErrorExpandOpts struct {
+	// Keys limits expansion to error values of these keys. If
+	// empty every error value is expanded.
+	Keys []string
+
+	// MaxDepth is the maximum number of wrapped causes listed in
+	// the chain. Defaults to 10.
+	MaxDepth int
+
+	// Stack adds a stack trace for each expanded error, using the
+	// one carried by the error if there is one, otherwise capturing
+	// it at the log call. Capturing is not cheap, so consider
+	// setting StackLevels.
+	Stack bool
+
+	// StackLevels, if not empty, limits Stack to records logged at
+	// these levels, e.g. log2.ERROR. Records filtered by calling
+	// Filter directly, without a level, get no stacks.
+	StackLevels []log2.Level
+
+	// MaxFrames limits the frames in stack traces, carried or
+	// captured. Defaults to 32.
+	MaxFrames int
+}
+
+// ErrorExpandFilterFac returns a FiltererFac for a Filterer that
+// expands error values into structured keyvals. For an error under
+// key "err" the record gets:
+//
+//	err        the error message
+//	err.type   the error's Go type, e.g. *fs.PathError
+//	err.chain  []string of the wrapped causes' messages, if any
+//	err.types  []string of the wrapped causes' types, if any
+//	err.stack  the stack trace, if opts.Stack is set
+//
+// Causes are found with Unwrap() error and Unwrap() []error, the same
+// as errors.Is, so the chain lists everything errors.Is would match
+// against.
+func ErrorExpandFilterFac(opts ErrorExpandOpts) func() (Filterer, error) {
+	if opts.MaxDepth <= 0 {
+		opts.MaxDepth = 10
+	}
+	if opts.MaxFrames <= 0 {
+		opts.MaxFrames = 32
+	}
+	rv := &errExpandFilter{opts: opts, keys: make(map[string]bool)}
+	for _, k := range opts.Keys {
+		rv.keys[k] = true
+	}
+	if len(opts.StackLevels) > 0 {
+		rv.stackLevels = make(map[log2.Level]bool)
+		for _, l := range opts.StackLevels {
+			rv.stackLevels[l] = true
+		}
+	}
+	return func() (Filterer, error) {
+		return rv, nil
+	}
+}
+
+// errExpandFilter is a LevelFilterer so it can limit stacks by level
+type errExpandFilter struct {
+	opts        ErrorExpandOpts
+	keys        map[string]bool
+	stackLevels map[log2.Level]bool // nil for all levels
+}
+
+func (o *errExpandFilter) Filter(keyvals []interface{}) ([]interface{}, error) {
+	return expandErrors(keyvals, o.keys, o.opts, o.opts.Stack && o.stackLevels == nil), nil
+}
+
+func (o *errExpandFilter) FilterLevel(level log2.Level, keyvals []interface{}) ([]interface{}, error) {
+	stack := o.opts.Stack && (o.stackLevels == nil || o.stackLevels[level])
+	return expandErrors(keyvals, o.keys, o.opts, stack), nil
+}
+
+func expandErrors(keyvals []interface{}, keys map[string]bool, opts ErrorExpandOpts, stack bool) []interface{} {
+	var rv []interface{}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		err, ok := keyvals[i+1].(error)
+		k, isStr := keyvals[i].(string)
+		if !ok || !isStr || (len(keys) > 0 && !keys[k]) {
+			if rv != nil {
+				rv = append(rv, keyvals[i], keyvals[i+1])
+			}
+			continue
+		}
+		if rv == nil {
+			rv = make([]interface{}, i, len(keyvals)+8)
+			copy(rv, keyvals[:i])
+		}
+		rv = append(rv, k, safeError(err), k+".type", fmt.Sprintf("%T", err))
+		msgs, types := errChain(err, opts.MaxDepth)
+		if len(msgs) > 0 {
+			rv = append(rv, k+".chain", msgs, k+".types", types)
+		}
+		if stack {
+			rv = append(rv, k+".stack", errStack(err, opts.MaxFrames))
+		}
+	}
+	if rv == nil {
+		return keyvals
+	}
+	if len(keyvals)%2 != 0 {
+		rv = append(rv, keyvals[len(keyvals)-1])
+	}
+	return rv
+}
+
+// errChain returns the messages and types of the errors wrapped by
+// err, depth first, up to max of them.
+func errChain(err error, max int) (msgs, types []string) {
+	var walk func(error)
+	walk = func(e error) {
+		if isNilPtr(e) {
+			return // its methods may panic
+		}
+		var causes []error
+		switch u := e.(type) {
+		case interface{ Unwrap() error }:
+			if c := u.Unwrap(); c != nil {
+				causes = []error{c}
+			}
+		case interface{ Unwrap() []error }:
+			causes = u.Unwrap()
+		}
+		for _, c := range causes {
+			if c == nil || len(msgs) >= max {
+				continue
+			}
+			msgs = append(msgs, safeError(c))
+			types = append(types, fmt.Sprintf("%T", c))
+			walk(c)
+		}
+	}
+	walk(err)
+	return
+}
+
+// errStack returns the stack trace carried by err or any error in
+// its chain, or else one captured from the caller of logfu.
+func errStack(err error, maxFrames int) string {
+	for e := err; e != nil && !isNilPtr(e); e = errors.Unwrap(e) {
+		if s, ok := carriedStack(e, maxFrames); ok {
+			return s
+		}
+	}
+	return callerStack(maxFrames)
+}
+
+// carriedStack looks for the common ways errors carry stacks:
+// github.com/pkg/errors' StackTrace(), Stack() []byte and Callers()
+// []uintptr, limited to maxFrames frames
+func carriedStack(err error, maxFrames int) (string, bool) {
+	switch e := err.(type) {
+	case interface{ Stack() []byte }:
+		return limitFrames(strings.TrimSuffix(string(e.Stack()), "\n"), maxFrames), true
+	case interface{ Callers() []uintptr }:
+		return formatFrames(runtime.CallersFrames(e.Callers()), maxFrames), true
+	}
+	// pkg/errors StackTrace() returns its own type, so avoid
+	// depending on it by calling through reflection
+	m := reflect.ValueOf(err).MethodByName("StackTrace")
+	if m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() == 1 {
+		s := strings.TrimPrefix(fmt.Sprintf("%+v", m.Call(nil)[0].Interface()), "\n")
+		return limitFrames(s, maxFrames), true
+	}
+	return "", false
+}
+
+// limitFrames cuts a formatted stack, of function and tab-indented
+// file:line line pairs after an optional "goroutine N" header as from
+// runtime/debug.Stack, to max frames
+func limitFrames(s string, max int) string {
+	lines := 2 * max
+	if strings.HasPrefix(s, "goroutine ") {
+		lines++
+	}
+	i := 0
+	for ; lines > 0 && i < len(s); lines-- {
+		j := strings.IndexByte(s[i:], '\n')
+		if j < 0 {
+			return s
+		}
+		i += j + 1
+	}
+	if i == 0 || i >= len(s) {
+		return s
+	}
+	return s[:i-1]
+}
+
+// callerStack returns the stack of the goroutine calling it, less
+// the leading logfu and log2 frames.
+func callerStack(maxFrames int) string {
+	pc := make([]uintptr, maxFrames+16)
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		f, more := frames.Next()
+		if !isLogfuFrame(f.Function) {
+			var sb strings.Builder
+			writeFrame(&sb, f)
+			if maxFrames > 1 && more {
+				sb.WriteString(formatFrames(frames, maxFrames-1))
+			}
+			return strings.TrimSuffix(sb.String(), "\n")
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+func isLogfuFrame(fn string) bool {
+	return strings.HasPrefix(fn, "github.com/msample/logfu.") ||
+		strings.HasPrefix(fn, "github.com/msample/log2.")
+}
+
+// formatFrames formats up to max frames, all of them if max < 0
+func formatFrames(frames *runtime.Frames, max int) string {
+	var sb strings.Builder
+	for i := 0; max < 0 || i < max; i++ {
+		f, more := frames.Next()
+		if f.Function == "" && f.File == "" {
+			break
+		}
+		writeFrame(&sb, f)
+		if !more {
+			break
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func writeFrame(sb *strings.Builder, f runtime.Frame) {
+	fmt.Fprintf(sb, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+}
@@ -0,0 +1,312 @@
+package logfu
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prober may be implemented by writers used with FailoverWriterFac
+// or FanoutWriterFac to check their health without writing a
+// record. Writers that don't are probed by making a new one with
+// their WriterFac.
+type Prober interface {
+	Probe() error
+}
+
+// HealthOpts configures the sink health tracking of FailoverWriter
+// and FanoutWriter.
+type HealthOpts struct {
+	// ProbeInterval is how often failed writers are probed in the
+	// background. Defaults to 5s.
+	ProbeInterval time.Duration
+
+	// OnChange, if set, is called with a writer's index and error
+	// when a write to it fails, and with a nil error when a probe
+	// finds it healthy again. It must not call the writer.
+	OnChange func(i int, err error)
+}
+
+// FailoverWriterFac returns a WriterFac for a FailoverWriter over the
+// writers made by wfs, in priority order. It fails only if none of
+// them can be made.
+func FailoverWriterFac(opts HealthOpts, wfs ...func() (io.Writer, error)) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		s, err := newSinkSet(opts, wfs)
+		if err != nil {
+			return nil, err
+		}
+		return &FailoverWriter{s}, nil
+	}
+}
+
+// FanoutWriterFac returns a WriterFac for a FanoutWriter over the
+// writers made by wfs. It fails only if none of them can be made.
+func FanoutWriterFac(opts HealthOpts, wfs ...func() (io.Writer, error)) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		s, err := newSinkSet(opts, wfs)
+		if err != nil {
+			return nil, err
+		}
+		return &FanoutWriter{s}, nil
+	}
+}
+
+// FailoverWriter writes each record to the first healthy writer, the
+// primary unless it has failed. A writer that fails is marked
+// unhealthy and the record is written to the next one. Unhealthy
+// writers are probed in the background and used again once they
+// pass, so it fails back to the primary. Safe for concurrent use.
+type FailoverWriter struct {
+	*sinkSet
+}
+
+func (o *FailoverWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for i, w := range o.writers {
+		if o.errs[i] != nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			o.fail(i, err)
+			continue
+		}
+		return len(p), nil
+	}
+	return 0, fmt.Errorf("failover: no healthy writer: %v", o.errsString())
+}
+
+// Active returns the index of the writer records go to, or -1 if
+// none is healthy.
+func (o *FailoverWriter) Active() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for i, err := range o.errs {
+		if err == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// FanoutWriter writes each record to every healthy writer. A writer
+// that fails is skipped until a background probe finds it healthy
+// again, so a broken sink doesn't hold up the others. Safe for
+// concurrent use.
+//
+// If some writers failed or are unhealthy Write returns a
+// *PartialWriteError, with n of len(p) if any succeeded or 0 if none
+// did.
+type FanoutWriter struct {
+	*sinkSet
+}
+
+// PartialWriteError is returned by FanoutWriter when writers failed
+// or were skipped.
+type PartialWriteError struct {
+	Errs []error // by writer index, nil for those written to
+}
+
+func (e *PartialWriteError) Error() string {
+	var b strings.Builder
+	n := 0
+	for i, err := range e.Errs {
+		if err != nil {
+			if n > 0 {
+				b.WriteString("; ")
+			}
+			fmt.Fprintf(&b, "[%v] %v", i, err)
+			n++
+		}
+	}
+	return fmt.Sprintf("write failed for %v of %v writers: %v", n, len(e.Errs), b.String())
+}
+
+func (o *FanoutWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var pe *PartialWriteError
+	ok := 0
+	for i, w := range o.writers {
+		err := o.errs[i]
+		if err == nil {
+			if _, err = w.Write(p); err != nil {
+				o.fail(i, err)
+			}
+		}
+		if err != nil {
+			if pe == nil {
+				pe = &PartialWriteError{Errs: make([]error, len(o.writers))}
+			}
+			pe.Errs[i] = err
+			continue
+		}
+		ok++
+	}
+	switch {
+	case pe == nil:
+		return len(p), nil
+	case ok == 0:
+		return 0, pe
+	}
+	return len(p), pe
+}
+
+// sinkSet holds writers with their health, probing the unhealthy
+// ones in the background
+type sinkSet struct {
+	opts    HealthOpts
+	facs    []func() (io.Writer, error)
+	mutex   sync.Mutex
+	writers []io.Writer
+	errs    []error // nil if healthy
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newSinkSet(opts HealthOpts, facs []func() (io.Writer, error)) (*sinkSet, error) {
+	if len(facs) == 0 {
+		return nil, errors.New("no writers")
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 5 * time.Second
+	}
+	rv := &sinkSet{
+		opts:    opts,
+		facs:    facs,
+		writers: make([]io.Writer, len(facs)),
+		errs:    make([]error, len(facs)),
+		done:    make(chan struct{}),
+	}
+	ok := false
+	for i, f := range facs {
+		rv.writers[i], rv.errs[i] = f()
+		ok = ok || rv.errs[i] == nil
+	}
+	if !ok {
+		return nil, fmt.Errorf("no writer could be made: %v", rv.errsString())
+	}
+	rv.wg.Add(1)
+	go rv.prober()
+	return rv, nil
+}
+
+// Errs returns each writer's error, nil for healthy ones.
+func (o *sinkSet) Errs() []error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]error(nil), o.errs...)
+}
+
+func (o *sinkSet) nested() []io.Writer {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return append([]io.Writer(nil), o.writers...)
+}
+
+// Close stops the prober and closes the writers that are io.Closers.
+func (o *sinkSet) Close() error {
+	o.mutex.Lock()
+	select {
+	case <-o.done:
+		o.mutex.Unlock()
+		return nil
+	default:
+	}
+	close(o.done)
+	o.mutex.Unlock()
+	o.wg.Wait()
+
+	var errs []error
+	for _, w := range o.writers {
+		if c, ok := w.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("error(s) closing writers: %v", errs)
+	}
+	return nil
+}
+
+// fail marks writer i unhealthy. Called with mutex held.
+func (o *sinkSet) fail(i int, err error) {
+	o.errs[i] = err
+	if o.opts.OnChange != nil {
+		o.opts.OnChange(i, err)
+	}
+}
+
+func (o *sinkSet) errsString() string {
+	var s []string
+	for i, err := range o.errs {
+		if err != nil {
+			s = append(s, fmt.Sprintf("[%v] %v", i, err))
+		}
+	}
+	return strings.Join(s, "; ")
+}
+
+func (o *sinkSet) prober() {
+	defer o.wg.Done()
+	t := time.NewTicker(o.opts.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-t.C:
+		}
+		o.mutex.Lock()
+		var failed []int
+		for i, err := range o.errs {
+			if err != nil {
+				failed = append(failed, i)
+			}
+		}
+		o.mutex.Unlock()
+
+		// unhealthy writers aren't written to, so they can be
+		// probed and replaced without holding the mutex
+		for _, i := range failed {
+			select {
+			case <-o.done:
+				return
+			default:
+			}
+			w, err := o.probe(o.writers[i], o.facs[i])
+			o.mutex.Lock()
+			o.writers[i] = w
+			if err == nil {
+				o.errs[i] = nil
+				if o.opts.OnChange != nil {
+					o.opts.OnChange(i, nil)
+				}
+			}
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// probe checks w, returning it or its replacement
+func (o *sinkSet) probe(w io.Writer, fac func() (io.Writer, error)) (io.Writer, error) {
+	if p, ok := w.(Prober); ok {
+		return w, p.Probe()
+	}
+	nw, err := fac()
+	if err != nil {
+		return w, err
+	}
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+	return nw, nil
+}
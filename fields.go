@@ -0,0 +1,75 @@
+package logfu
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Field is a keyval added to every record by FieldsFilterFac. Its
+// value comes from the first of these that is available when the
+// factory is called: the Env environment variable, the contents of
+// File (trailing whitespace trimmed), or Value. A Field with none of
+// these is left out.
+type Field struct {
+	Key   string
+	Value interface{}
+	Env   string // e.g. "POD_NAME"
+	File  string // e.g. a Kubernetes downward API file
+}
+
+// FieldsFilterFac returns a FiltererFac for a Filterer that prepends
+// the given fields to each record, e.g.
+//
+//	logfu.FieldsFilterFac(
+//		logfu.Field{Key: "service", Value: "billing"},
+//		logfu.Field{Key: "version", Value: version},
+//		logfu.Field{Key: "env", Env: "DEPLOY_ENV", Value: "dev"},
+//		logfu.Field{Key: "pod", Env: "POD_NAME", File: "/etc/podinfo/name"},
+//	)
+//
+// Env vars and files are read each time the factory is called, so
+// ReloadMode picks up changed values.
+func FieldsFilterFac(fields ...Field) func() (Filterer, error) {
+	fs := make([]Field, len(fields))
+	copy(fs, fields)
+	return func() (Filterer, error) {
+		var kvs []interface{}
+		for _, f := range fs {
+			if f.Key == "" {
+				return nil, fmt.Errorf("field with empty key")
+			}
+			v, ok, err := f.resolve()
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				kvs = append(kvs, f.Key, v)
+			}
+		}
+		return FilterFunc(func(keyvals []interface{}) ([]interface{}, error) {
+			rv := make([]interface{}, 0, len(kvs)+len(keyvals))
+			return append(append(rv, kvs...), keyvals...), nil
+		}), nil
+	}
+}
+
+// resolve returns the field's value per the Field doc. A missing env
+// var or file is not an error, other read errors are.
+func (o Field) resolve() (interface{}, bool, error) {
+	if o.Env != "" {
+		if v, ok := os.LookupEnv(o.Env); ok {
+			return v, true, nil
+		}
+	}
+	if o.File != "" {
+		b, err := os.ReadFile(o.File)
+		if err == nil {
+			return strings.TrimRight(string(b), " \t\r\n"), true, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("field %v: %v", o.Key, err)
+		}
+	}
+	return o.Value, o.Value != nil, nil
+}
@@ -13,3 +13,13 @@ func IdentityFilterFac() (Filterer, error) {
 func IdentityFilter(keyvals []interface{}) ([]interface{}, error) {
 	return keyvals, nil
 }
+
+// lookup returns the value of the first keyval with the given key
+func lookup(keyvals []interface{}, key string) (interface{}, bool) {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if s, ok := keyvals[i].(string); ok && s == key {
+			return keyvals[i+1], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,321 @@
+package logfu_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msample/log2"
+	"github.com/msample/logfu"
+)
+
+func TestRateLimitFilter(t *testing.T) {
+	f := logfu.NewRateLimitFilter(logfu.RateLimitOpts{Rate: 0.001, Burst: 2})
+	defer f.Close()
+
+	passed := 0
+	for i := 0; i < 10; i++ {
+		kv, err := f.Filter([]interface{}{"msg", "boom", "n", i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(kv) != 0 {
+			passed++
+		}
+	}
+	if passed != 2 {
+		t.Errorf("expected 2 records to pass, got %v", passed)
+	}
+
+	// different key has its own bucket
+	kv, _ := f.Filter([]interface{}{"msg", "other"})
+	if len(kv) != 2 {
+		t.Errorf("expected other key to pass unchanged: %v", kv)
+	}
+}
+
+func TestRateLimitFilterMaxKeys(t *testing.T) {
+	f := logfu.NewRateLimitFilter(logfu.RateLimitOpts{Rate: 0.001, MaxKeys: 10})
+	defer f.Close()
+
+	// every key has suppressed records so pruning can't free any
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 2; j++ {
+			f.Filter([]interface{}{"msg", fmt.Sprint("k", i)})
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the oldest keys were dropped, so k0 starts over with a full
+	// bucket, and the newest are still limited
+	if kv, _ := f.Filter([]interface{}{"msg", "k0"}); len(kv) != 2 {
+		t.Errorf("expected the oldest key to have been dropped, got %v", kv)
+	}
+	if kv, _ := f.Filter([]interface{}{"msg", "k19"}); len(kv) != 0 {
+		t.Errorf("expected the newest key to still be limited, got %v", kv)
+	}
+}
+
+func TestRateLimitFilterDedup(t *testing.T) {
+	f := logfu.NewRateLimitFilter(logfu.RateLimitOpts{DedupWindow: 20 * time.Millisecond})
+	defer f.Close()
+
+	rec := []interface{}{"msg", "boom", "err", "EOF"}
+	if kv, _ := f.Filter(rec); len(kv) == 0 {
+		t.Fatal("first record should pass")
+	}
+	for i := 0; i < 3; i++ {
+		if kv, _ := f.Filter(rec); len(kv) != 0 {
+			t.Fatal("duplicate record should be suppressed")
+		}
+	}
+	if kv, _ := f.Filter([]interface{}{"msg", "boom", "err", "EOF", "x", 1}); len(kv) != 4+2+2 {
+		t.Errorf("non-duplicate should pass with suppressed count: %v", kv)
+	} else if kv[len(kv)-2] != "suppressed" || kv[len(kv)-1] != 3 {
+		t.Errorf("expected suppressed 3, got %v", kv[len(kv)-2:])
+	}
+	time.Sleep(25 * time.Millisecond)
+	if kv, _ := f.Filter(rec); len(kv) == 0 {
+		t.Error("duplicate outside window should pass")
+	}
+}
+
+func TestRateLimitFilterEmit(t *testing.T) {
+	ch := make(chan []interface{}, 1)
+	f := logfu.NewRateLimitFilter(logfu.RateLimitOpts{
+		Rate:            0.001,
+		SummaryInterval: 10 * time.Millisecond,
+		Emit: func(kv ...interface{}) error {
+			ch <- kv
+			return nil
+		},
+	})
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		f.Filter([]interface{}{"msg", "boom"})
+	}
+	select {
+	case kv := <-ch:
+		if kv[1] != "suppressed 4 similar records" {
+			t.Errorf("unexpected summary: %v", kv)
+		}
+	case <-time.After(time.Second):
+		t.Error("no summary emitted")
+	}
+}
+
+func TestSampleFilterHash(t *testing.T) {
+	f, err := logfu.NewSampleFilter(logfu.SampleOpts{Rate: 0.5, HashKey: "trace_id", RateKey: "sample_rate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprint("trace-", i)
+		kv1, _ := f.Filter([]interface{}{"msg", "a", "trace_id", id})
+		kv2, _ := f.Filter([]interface{}{"msg", "b", "trace_id", id})
+		if (len(kv1) == 0) != (len(kv2) == 0) {
+			t.Fatalf("records for %v sampled inconsistently", id)
+		}
+		if len(kv1) != 0 {
+			kept++
+			if kv1[4] != "sample_rate" || kv1[5] != 0.5 {
+				t.Fatalf("expected sample_rate keyval: %v", kv1)
+			}
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("expected roughly half kept, got %v", kept)
+	}
+}
+
+func TestSampleFilterCounted(t *testing.T) {
+	f, err := logfu.NewSampleFilter(logfu.SampleOpts{First: 3, Thereafter: 10, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := 0
+	for i := 0; i < 53; i++ {
+		if kv, _ := f.Filter([]interface{}{"msg", "a"}); len(kv) != 0 {
+			kept++
+		}
+	}
+	if kept != 3+5 {
+		t.Errorf("expected 8 kept, got %v", kept)
+	}
+
+	if _, err := logfu.NewSampleFilter(logfu.SampleOpts{Rate: 2}); err == nil {
+		t.Error("expected error for rate > 1")
+	}
+	if _, err := logfu.NewSampleFilter(logfu.SampleOpts{}); err == nil {
+		t.Error("expected error for zero rate without First or Thereafter")
+	}
+}
+
+func TestMatchExpr(t *testing.T) {
+	rec := []interface{}{"msg", "connection refused", "path", "/healthz", "status", 503, "tenant", "acme", "lat", "1.5"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`path == "/healthz"`, true},
+		{`path != "/healthz"`, false},
+		{`missing != "x"`, true},
+		{`missing == "x"`, false},
+		{`status >= 500 and tenant == "acme"`, true},
+		{`status < 500 || tenant == "other"`, false},
+		{`status == 503`, true},
+		{`lat > 1.2`, true},
+		{`msg =~ "^conn(ection)? refused$"`, true},
+		{`msg !~ "refused"`, false},
+		{`exists(tenant) && !exists(err)`, true},
+		{`not (path == "/healthz" or status == 200)`, false},
+		{`true and not false`, true},
+	}
+	for _, tc := range tests {
+		m, err := logfu.ParseMatch(tc.expr)
+		if err != nil {
+			t.Errorf("%v: %v", tc.expr, err)
+			continue
+		}
+		if got := m.Match(rec); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{``, `path ==`, `path = "x"`, `(a == 1`, `a =~ "("`, `a < "x"`, `a == "x" b`, `"unterminated`} {
+		if _, err := logfu.ParseMatch(bad); err == nil {
+			t.Errorf("expected parse error for %v", bad)
+		}
+	}
+}
+
+func TestDropFilterFac(t *testing.T) {
+	f, err := logfu.DropFilterFac(`path == "/healthz"`)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv, _ := f.Filter([]interface{}{"path", "/healthz"}); len(kv) != 0 {
+		t.Error("expected record to be dropped")
+	}
+	if kv, _ := f.Filter([]interface{}{"path", "/api"}); len(kv) != 2 {
+		t.Error("expected record to be kept")
+	}
+	if _, err := logfu.MatchFilterFac(`path ==`)(); err == nil {
+		t.Error("expected factory error for bad expression")
+	}
+}
+
+func TestErrorExpandFilter(t *testing.T) {
+	f, err := logfu.ErrorExpandFilterFac(logfu.ErrorExpandOpts{Stack: true})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := os.ErrNotExist
+	e := fmt.Errorf("loading config: %w", errors.Join(base, io.EOF))
+	kv, _ := f.Filter([]interface{}{"msg", "boom", "err", e, "n", 1})
+
+	got := make(map[string]interface{})
+	for i := 0; i < len(kv); i += 2 {
+		got[kv[i].(string)] = kv[i+1]
+	}
+	if got["err"] != e.Error() || got["err.type"] != "*fmt.wrapError" || got["n"] != 1 {
+		t.Errorf("unexpected expansion: %v", kv)
+	}
+	chain, _ := got["err.chain"].([]string)
+	if len(chain) != 3 || chain[1] != base.Error() || chain[2] != "EOF" {
+		t.Errorf("unexpected chain: %q", chain)
+	}
+	stack, _ := got["err.stack"].(string)
+	if !strings.HasPrefix(stack, "github.com/msample/logfu_test.TestErrorExpandFilter") {
+		t.Errorf("expected stack to start at the log call: %v", stack)
+	}
+
+	f, _ = logfu.ErrorExpandFilterFac(logfu.ErrorExpandOpts{Keys: []string{"cause"}})()
+	kv, _ = f.Filter([]interface{}{"err", e})
+	if len(kv) != 2 || kv[1] != e {
+		t.Errorf("expected err to be left alone: %v", kv)
+	}
+
+	// stacks only at the given levels, cut to MaxFrames
+	f, _ = logfu.ErrorExpandFilterFac(logfu.ErrorExpandOpts{
+		Stack:       true,
+		StackLevels: []log2.Level{log2.ERROR},
+		MaxFrames:   2,
+	})()
+	lf := f.(logfu.LevelFilterer)
+	kv, _ = lf.FilterLevel(log2.WARN, []interface{}{"err", e})
+	if len(kv) != 8 || kv[6] != "err.types" {
+		t.Errorf("expected no stack for WARN: %v", kv)
+	}
+	kv, _ = lf.FilterLevel(log2.ERROR, []interface{}{"err", stackErr{}})
+	want := "goroutine 1 [running]:\nmain.a()\n\t/a.go:1\nmain.b()\n\t/b.go:2"
+	if len(kv) != 6 || kv[5] != want {
+		t.Errorf("expected carried stack cut to 2 frames, got %q", kv)
+	}
+}
+
+func TestErrorExpandFilterNilPtr(t *testing.T) {
+	f, _ := logfu.ErrorExpandFilterFac(logfu.ErrorExpandOpts{Stack: true})()
+	var nilErr *ptrErr
+	for _, e := range []error{nilErr, fmt.Errorf("wrapped: %w", nilErr)} {
+		kv, err := f.Filter([]interface{}{"err", e})
+		if err != nil || len(kv) < 4 || kv[3] != fmt.Sprintf("%T", e) {
+			t.Errorf("unexpected expansion of %T: %v %v", e, kv, err)
+		}
+	}
+}
+
+// ptrErr's methods panic on a nil pointer
+type ptrErr struct {
+	msg string
+	err error
+}
+
+func (e *ptrErr) Error() string { return e.msg }
+
+func (e *ptrErr) Unwrap() error { return e.err }
+
+type stackErr struct{}
+
+func (stackErr) Error() string { return "failed" }
+
+func (stackErr) Stack() []byte {
+	return []byte("goroutine 1 [running]:\nmain.a()\n\t/a.go:1\nmain.b()\n\t/b.go:2\nmain.c()\n\t/c.go:3\n")
+}
+
+func TestFieldsFilterFac(t *testing.T) {
+	dir := t.TempDir()
+	pod := filepath.Join(dir, "name")
+	if err := os.WriteFile(pod, []byte("pod-1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOGFU_TEST_ENV", "prod")
+	fac := logfu.FieldsFilterFac(
+		logfu.Field{Key: "service", Value: "billing"},
+		logfu.Field{Key: "env", Env: "LOGFU_TEST_ENV", Value: "dev"},
+		logfu.Field{Key: "region", Env: "LOGFU_TEST_UNSET"},
+		logfu.Field{Key: "pod", File: pod},
+	)
+	f, err := fac()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, _ := f.Filter([]interface{}{"msg", "hi"})
+	if got := fmt.Sprint(kv); got != "[service billing env prod pod pod-1 msg hi]" {
+		t.Errorf("unexpected keyvals: %v", got)
+	}
+
+	// factory re-reads sources
+	os.WriteFile(pod, []byte("pod-2"), 0644)
+	f, _ = fac()
+	kv, _ = f.Filter(nil)
+	if kv[5] != "pod-2" {
+		t.Errorf("expected changed file value: %v", kv)
+	}
+}
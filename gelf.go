@@ -0,0 +1,368 @@
+package logfu
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/msample/log2"
+)
+
+// GELFOpts configures the Serializer returned by GELFSerializerFac.
+type GELFOpts struct {
+	// Host is the GELF host field. Defaults to os.Hostname().
+	Host string
+
+	// MsgKey's value becomes short_message. Defaults to "msg".
+	MsgKey string
+
+	// FullMsgKey's value, if set and present, becomes
+	// full_message, e.g. "err.stack".
+	FullMsgKey string
+
+	// LevelKey's value (a LevelName) is mapped to the syslog
+	// severity in the GELF level field when the serializer isn't
+	// called by a Config's log func, which gives it the level.
+	// Defaults to LevelKey.
+	LevelKey string
+
+	// TimeKey's time.Time value becomes the GELF timestamp,
+	// otherwise the current time is used. Defaults to "ts".
+	TimeKey string
+}
+
+// GELFSerializerFac returns a SerializerFac for Graylog GELF 1.1
+// JSON. Keyvals other than those named in opts become "_" prefixed
+// additional fields with characters GELF doesn't allow in names
+// replaced by "_". Numbers are kept as numbers, other values are
+// written as strings. No delimiter is written after each record;
+// use the GELF writers to frame records for the network.
+func GELFSerializerFac(opts GELFOpts) func() (Serializer, error) {
+	if opts.MsgKey == "" {
+		opts.MsgKey = "msg"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	if opts.TimeKey == "" {
+		opts.TimeKey = "ts"
+	}
+	return func() (Serializer, error) {
+		o := opts
+		if o.Host == "" {
+			h, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			o.Host = h
+		}
+		return &gelfSerializer{o}, nil
+	}
+}
+
+type gelfSerializer struct {
+	opts GELFOpts
+}
+
+func (o *gelfSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	return gelfSerialize(w, keyvals, &o.opts, -1)
+}
+
+func (o *gelfSerializer) SerializeLevel(level log2.Level, w io.Writer, keyvals []interface{}) error {
+	l, ok := gelfLevels[LevelName(level)]
+	if !ok {
+		l = gelfLevels["info"]
+	}
+	return gelfSerialize(w, keyvals, &o.opts, l)
+}
+
+// gelfLevels maps level names to syslog severities
+var gelfLevels = map[string]int{
+	"error": 3,
+	"warn":  4,
+	"audit": 5,
+	"info":  6,
+	"debug": 7,
+}
+
+// gelfSerialize writes keyvals at the given severity, or the one for
+// the LevelKey keyval if level is negative
+func gelfSerialize(w io.Writer, keyvals []interface{}, o *GELFOpts, level int) error {
+	bp := getBuf()
+	defer putBuf(bp)
+	b := append((*bp)[:0], `{"version":"1.1","host":`...)
+	b = appendJSONString(b, o.Host)
+
+	var msg, full string = missingValue, ""
+	var ts time.Time
+	keyLevel := gelfLevels["info"]
+	var extra []byte
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch k {
+		case o.MsgKey:
+			msg = valueString(v)
+			continue
+		case o.LevelKey:
+			if l, ok := gelfLevels[valueString(v)]; ok {
+				keyLevel = l
+			}
+			continue
+		case o.TimeKey:
+			if t, ok := v.(time.Time); ok {
+				ts = t
+				continue
+			}
+		}
+		if k == o.FullMsgKey && o.FullMsgKey != "" {
+			full = valueString(v)
+			continue
+		}
+		extra = append(extra, ',', '"', '_')
+		extra = appendGELFName(extra, k)
+		extra = append(extra, '"', ':')
+		if _, ok := toFloat(v); ok {
+			if _, isStr := v.(string); !isStr {
+				var err error
+				if extra, err = appendJSONValue(extra, v); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		extra = appendJSONString(extra, valueString(v))
+	}
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if level < 0 {
+		level = keyLevel
+	}
+
+	b = append(b, `,"short_message":`...)
+	b = appendJSONString(b, msg)
+	if full != "" {
+		b = append(b, `,"full_message":`...)
+		b = appendJSONString(b, full)
+	}
+	b = append(b, `,"timestamp":`...)
+	b = appendJSONFloat(b, math.Round(float64(ts.UnixNano())/1e6)/1e3, 64)
+	b = append(b, `,"level":`...)
+	b = append(b, byte('0'+level))
+	b = append(b, extra...)
+	b = append(b, '}')
+	*bp = b
+	_, err := w.Write(b)
+	return err
+}
+
+// appendGELFName appends k with chars outside [\w.-] replaced with _
+// and "id", which GELF reserves, renamed to "id_"
+func appendGELFName(dst []byte, k string) []byte {
+	if k == "id" {
+		return append(dst, "id_"...)
+	}
+	for i := 0; i < len(k); i++ {
+		c := k[i]
+		if c == '.' || c == '-' || c == '_' || c >= '0' && c <= '9' ||
+			c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			dst = append(dst, c)
+		} else {
+			dst = append(dst, '_')
+		}
+	}
+	return dst
+}
+
+// GELFCompression selects GELF UDP payload compression
+type GELFCompression int
+
+const (
+	GELFNoCompression GELFCompression = iota
+	GELFGzip
+	GELFZlib
+)
+
+const (
+	// GELFChunkSize is the default max UDP datagram size used by
+	// GELFUDPWriterFac, suitable for typical 1500 byte MTUs.
+	GELFChunkSize = 1420
+
+	gelfChunkHeader = 12
+	gelfMaxChunks   = 128
+)
+
+// GELFUDPWriterFac returns a WriterFac for a GELFUDPWriter sending
+// to addr (host:port). chunkSize is the maximum datagram size,
+// GELFChunkSize if <= 0.
+func GELFUDPWriterFac(addr string, comp GELFCompression, chunkSize int) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewGELFUDPWriter(addr, comp, chunkSize)
+	}
+}
+
+// GELFUDPWriter sends each Write as one GELF UDP message, compressed
+// and chunked as necessary.  Safe for concurrent use.
+type GELFUDPWriter struct {
+	conn      net.Conn
+	comp      GELFCompression
+	chunkSize int
+	idBase    uint64
+	idSeq     uint64
+	mutex     sync.Mutex // serializes compression & chunk sends
+	zbuf      bytes.Buffer
+}
+
+// NewGELFUDPWriter returns a GELFUDPWriter sending to addr
+func NewGELFUDPWriter(addr string, comp GELFCompression, chunkSize int) (*GELFUDPWriter, error) {
+	if chunkSize <= 0 {
+		chunkSize = GELFChunkSize
+	}
+	if chunkSize <= gelfChunkHeader {
+		return nil, fmt.Errorf("GELF chunk size too small: %v", chunkSize)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &GELFUDPWriter{
+		conn:      conn,
+		comp:      comp,
+		chunkSize: chunkSize,
+		idBase:    binary.BigEndian.Uint64(id[:]),
+	}, nil
+}
+
+func (o *GELFUDPWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	msg := p
+	if o.comp != GELFNoCompression {
+		o.zbuf.Reset()
+		var zw io.WriteCloser
+		if o.comp == GELFGzip {
+			zw = gzip.NewWriter(&o.zbuf)
+		} else {
+			zw = zlib.NewWriter(&o.zbuf)
+		}
+		zw.Write(p)
+		if err := zw.Close(); err != nil {
+			return 0, err
+		}
+		msg = o.zbuf.Bytes()
+	}
+
+	if len(msg) <= o.chunkSize {
+		if _, err := o.conn.Write(msg); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	payload := o.chunkSize - gelfChunkHeader
+	n := (len(msg) + payload - 1) / payload
+	if n > gelfMaxChunks {
+		return 0, fmt.Errorf("GELF message too large: %v bytes needs %v chunks, max is %v", len(msg), n, gelfMaxChunks)
+	}
+	id := o.idBase + atomic.AddUint64(&o.idSeq, 1)
+	chunk := make([]byte, o.chunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	binary.BigEndian.PutUint64(chunk[2:10], id)
+	chunk[11] = byte(n)
+	for i := 0; i < n; i++ {
+		chunk[10] = byte(i)
+		end := (i + 1) * payload
+		if end > len(msg) {
+			end = len(msg)
+		}
+		m := copy(chunk[gelfChunkHeader:], msg[i*payload:end])
+		if _, err := o.conn.Write(chunk[:gelfChunkHeader+m]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (o *GELFUDPWriter) Close() error {
+	return o.conn.Close()
+}
+
+// GELFTCPWriterFac returns a WriterFac for a GELFTCPWriter
+// connected to addr (host:port).
+func GELFTCPWriterFac(addr string) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewGELFTCPWriter(addr)
+	}
+}
+
+// GELFTCPWriter sends each Write as a null-terminated GELF TCP
+// message.  If a write fails it reconnects and retries once. Safe
+// for concurrent use.
+type GELFTCPWriter struct {
+	addr  string
+	mutex sync.Mutex
+	conn  net.Conn
+	buf   []byte
+}
+
+// NewGELFTCPWriter returns a GELFTCPWriter connected to addr
+func NewGELFTCPWriter(addr string) (*GELFTCPWriter, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &GELFTCPWriter{addr: addr, conn: conn}, nil
+}
+
+func (o *GELFTCPWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.buf = append(append(o.buf[:0], p...), 0)
+	var err error
+	for try := 0; try < 2; try++ {
+		if o.conn == nil {
+			if o.conn, err = net.Dial("tcp", o.addr); err != nil {
+				return 0, err
+			}
+		}
+		if _, err = o.conn.Write(o.buf); err == nil {
+			return len(p), nil
+		}
+		o.conn.Close()
+		o.conn = nil
+	}
+	return 0, err
+}
+
+func (o *GELFTCPWriter) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	return err
+}
@@ -0,0 +1,622 @@
+package logfu
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTPRecord is a serialized record waiting to be sent by an
+// HTTPWriter, with the time it was written.
+type HTTPRecord struct {
+	Time time.Time
+	Data []byte
+}
+
+// HTTPFraming builds HTTPWriter request bodies for a target API.
+type HTTPFraming interface {
+	// ContentType is the request Content-Type.
+	ContentType() string
+
+	// AppendBody appends the body for a batch of records to dst.
+	AppendBody(dst []byte, records []HTTPRecord) ([]byte, error)
+}
+
+// HTTPResponseChecker may be implemented by an HTTPFraming to report
+// failures that an API returns with a 2xx status, like partial
+// Elasticsearch bulk failures. It returns a *PartialBatchError if
+// only some of the records failed, so only those count as dropped.
+type HTTPResponseChecker interface {
+	CheckResponse(body []byte) error
+}
+
+// PartialBatchError reports that Failed of a batch's Total records
+// were rejected, and the rest accepted.
+type PartialBatchError struct {
+	Failed int
+	Total  int
+	Err    error // detail, e.g. the first failure
+}
+
+func (e *PartialBatchError) Error() string {
+	return fmt.Sprintf("%v of %v records failed: %v", e.Failed, e.Total, e.Err)
+}
+
+// HTTPOpts configures an HTTPWriter.
+type HTTPOpts struct {
+	// URL is the ingestion endpoint. Basic auth credentials in it
+	// are sent with each request.
+	URL string
+
+	// Headers are added to each request, e.g. {"Authorization":
+	// "Splunk <token>"}.
+	Headers map[string]string
+
+	// Framing builds the request bodies. Defaults to
+	// NDJSONFraming().
+	Framing HTTPFraming
+
+	// A batch is sent when it has MaxRecords records, when adding
+	// a record would take it over MaxBytes, or MaxLatency after its
+	// first record was written. They default to 1000, 1MiB and 1s.
+	MaxRecords int
+	MaxBytes   int
+	MaxLatency time.Duration
+
+	// Gzip compresses request bodies.
+	Gzip bool
+
+	// Retries is the number of times a batch is resent after a
+	// network error or a 429 or 5xx status. Defaults to 5; use a
+	// negative value for none.
+	Retries int
+
+	// MinBackoff and MaxBackoff bound the jittered exponential
+	// delay between retries. They default to 100ms and 30s. A
+	// Retry-After response header overrides the delay, up to
+	// MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// CloseTimeout bounds how long Close waits for the queued
+	// batches, retries included; what's left is then dropped.
+	// Defaults to 5s, as Configs close writers during mode changes.
+	CloseTimeout time.Duration
+
+	// QueueSize is the number of full batches that may wait to be
+	// sent before Write blocks, without holding up other Writes
+	// until it must send a batch itself. Defaults to 4.
+	QueueSize int
+
+	// Client sends the requests. Defaults to an http.Client with a
+	// 30s timeout.
+	Client *http.Client
+}
+
+// HTTPWriterFac returns a WriterFac for an HTTPWriter.
+func HTTPWriterFac(opts HTTPOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewHTTPWriter(opts)
+	}
+}
+
+// HTTPWriter batches records and posts them to an HTTP ingestion
+// API, with the body built by its HTTPFraming. Batches are sent in
+// order by a background goroutine, so Write only blocks when
+// QueueSize batches are waiting.
+//
+// A batch that still fails after its retries, or gets another error
+// status, is dropped and the error returned by the next Write, Flush
+// or Close; Dropped counts them. Close sends what remains, retries
+// included, for up to CloseTimeout and stops the goroutine. Safe for
+// concurrent use.
+type HTTPWriter struct {
+	dropped uint64 // atomic, first for 32 bit platforms
+	opts    HTTPOpts
+	mutex   sync.Mutex
+	batch   []HTTPRecord
+	size    int
+	gen     int // batch generation, for the latency timer
+	timer   *time.Timer
+	closed  bool
+	errMu   sync.Mutex // separate as takeErr is called with and without mutex
+	err     error
+	queue   []httpBatch // waiting to be sent, guarded by mutex
+	queued  *sync.Cond  // on mutex, signaled when queue changes
+	stopped chan struct{}
+	ctx     context.Context // canceled when Close gives up
+	cancel  context.CancelFunc
+}
+
+type httpBatch struct {
+	records []HTTPRecord
+	done    chan struct{} // closed once sent, for Flush
+}
+
+// NewHTTPWriter returns a new HTTPWriter
+func NewHTTPWriter(opts HTTPOpts) (*HTTPWriter, error) {
+	if opts.URL == "" {
+		return nil, errors.New("http writer: no URL")
+	}
+	if opts.Framing == nil {
+		opts.Framing = NDJSONFraming()
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 1000
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	if opts.MaxLatency <= 0 {
+		opts.MaxLatency = time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 5
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 4
+	}
+	if opts.CloseTimeout <= 0 {
+		opts.CloseTimeout = 5 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	rv := &HTTPWriter{
+		opts:    opts,
+		stopped: make(chan struct{}),
+	}
+	rv.queued = sync.NewCond(&rv.mutex)
+	rv.ctx, rv.cancel = context.WithCancel(context.Background())
+	go rv.sender()
+	return rv, nil
+}
+
+func (o *HTTPWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.closed {
+		return 0, errors.New("http writer: closed")
+	}
+	shipped := false
+	if len(o.batch) > 0 && o.size+len(p) > o.opts.MaxBytes {
+		o.shipLocked(nil)
+		shipped = true
+	}
+	// p is usually a pooled buffer, so keep a copy
+	o.batch = append(o.batch, HTTPRecord{Time: time.Now(), Data: append([]byte(nil), p...)})
+	o.size += len(p)
+	if len(o.batch) == 1 {
+		gen := o.gen
+		o.timer = time.AfterFunc(o.opts.MaxLatency, func() { o.latencyFlush(gen) })
+	}
+	if len(o.batch) >= o.opts.MaxRecords || o.size >= o.opts.MaxBytes {
+		o.shipLocked(nil)
+		shipped = true
+	}
+	// Wait releases mutex, so other Writes carry on meanwhile
+	for shipped && len(o.queue) > o.opts.QueueSize && o.ctx.Err() == nil {
+		o.queued.Wait()
+	}
+	return len(p), o.takeErr()
+}
+
+// Flush sends the pending records and waits until every batch
+// written so far has been sent or dropped, returning the error from
+// any dropped ones.
+func (o *HTTPWriter) Flush() error {
+	done := make(chan struct{})
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return errors.New("http writer: closed")
+	}
+	o.shipLocked(done)
+	o.mutex.Unlock()
+	<-done
+	return o.takeErr()
+}
+
+// Close sends the pending records, waits up to CloseTimeout for all
+// batches to be sent or dropped, dropping the rest after that, and
+// stops the background goroutine.
+func (o *HTTPWriter) Close() error {
+	t := time.NewTimer(o.opts.CloseTimeout)
+	defer t.Stop()
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return nil
+	}
+	o.shipLocked(nil)
+	o.closed = true
+	o.queued.Broadcast()
+	o.mutex.Unlock()
+
+	select {
+	case <-o.stopped:
+	case <-t.C:
+	}
+	// aborts the request and retries in progress, and wakes
+	// blocked Writes
+	o.cancel()
+	o.mutex.Lock()
+	o.queued.Broadcast()
+	o.mutex.Unlock()
+	<-o.stopped
+	return o.takeErr()
+}
+
+// Dropped returns the number of records dropped so far, for
+// Metrics.
+func (o *HTTPWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&o.dropped)
+}
+
+func (o *HTTPWriter) takeErr() error {
+	o.errMu.Lock()
+	defer o.errMu.Unlock()
+	err := o.err
+	o.err = nil
+	return err
+}
+
+func (o *HTTPWriter) latencyFlush(gen int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !o.closed && gen == o.gen {
+		o.shipLocked(nil)
+	}
+}
+
+// shipLocked queues the current batch, if any, or just done. It
+// never blocks; Write waits for the queue to shrink after.
+func (o *HTTPWriter) shipLocked(done chan struct{}) {
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	if len(o.batch) == 0 && done == nil {
+		return
+	}
+	o.queue = append(o.queue, httpBatch{records: o.batch, done: done})
+	o.batch, o.size = nil, 0
+	o.gen++
+	o.queued.Broadcast()
+}
+
+// next returns the next batch to send, waiting for one, or false once
+// closed and all are sent
+func (o *HTTPWriter) next() (httpBatch, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for len(o.queue) == 0 && !o.closed {
+		o.queued.Wait()
+	}
+	if len(o.queue) == 0 {
+		return httpBatch{}, false
+	}
+	b := o.queue[0]
+	o.queue[0] = httpBatch{}
+	o.queue = o.queue[1:]
+	o.queued.Broadcast()
+	return b, true
+}
+
+func (o *HTTPWriter) sender() {
+	defer close(o.stopped)
+	var body []byte
+	for {
+		b, ok := o.next()
+		if !ok {
+			return
+		}
+		if len(b.records) > 0 {
+			var err error
+			if o.ctx.Err() != nil {
+				err = errors.New("not sent within CloseTimeout")
+			} else if body, err = o.opts.Framing.AppendBody(body[:0], b.records); err == nil {
+				if err = o.send(body); o.ctx.Err() != nil && err != nil {
+					err = fmt.Errorf("not sent within CloseTimeout: %v", err)
+				}
+			}
+			if err != nil {
+				n := len(b.records)
+				var pe *PartialBatchError
+				if errors.As(err, &pe) {
+					n = pe.Failed
+				}
+				atomic.AddUint64(&o.dropped, uint64(n))
+				o.errMu.Lock()
+				o.err = fmt.Errorf("http writer: dropped %v records: %v", n, err)
+				o.errMu.Unlock()
+			}
+		}
+		if b.done != nil {
+			close(b.done)
+		}
+	}
+}
+
+// send posts body, retrying per the options
+func (o *HTTPWriter) send(body []byte) error {
+	if o.opts.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	backoff := o.opts.MinBackoff
+	for try := 0; ; try++ {
+		wait, err := o.post(body)
+		if err == nil {
+			return nil
+		}
+		if wait < 0 || try >= o.opts.Retries {
+			return err
+		}
+		if wait == 0 {
+			// full jitter
+			wait = time.Duration(rand.Int63n(int64(backoff)) + 1)
+			if backoff *= 2; backoff > o.opts.MaxBackoff {
+				backoff = o.opts.MaxBackoff
+			}
+		} else if wait > o.opts.MaxBackoff {
+			wait = o.opts.MaxBackoff
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-o.ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// post makes one attempt. On failure wait is negative if it
+// shouldn't be retried, or the Retry-After delay.
+func (o *HTTPWriter) post(body []byte) (wait time.Duration, err error) {
+	req, err := http.NewRequestWithContext(o.ctx, "POST", o.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", o.opts.Framing.ContentType())
+	if o.opts.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range o.opts.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	rbody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		if c, ok := o.opts.Framing.(HTTPResponseChecker); ok {
+			if err := c.CheckResponse(rbody); err != nil {
+				return -1, err
+			}
+		}
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("%v", resp.Status)
+	}
+	return -1, fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(rbody))
+}
+
+// retryAfter returns the delay from a Retry-After header value, in
+// seconds or as an HTTP date, or 0
+func retryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// trimNL strips the trailing newline serializers add
+func trimNL(b []byte) []byte {
+	if n := len(b); n > 0 && b[n-1] == '\n' {
+		return b[:n-1]
+	}
+	return b
+}
+
+type ndjsonFraming struct{}
+
+// NDJSONFraming returns an HTTPFraming that writes one record per
+// line, for generic newline delimited JSON (or logfmt) endpoints.
+func NDJSONFraming() HTTPFraming {
+	return ndjsonFraming{}
+}
+
+func (ndjsonFraming) ContentType() string { return "application/x-ndjson" }
+
+func (ndjsonFraming) AppendBody(dst []byte, records []HTTPRecord) ([]byte, error) {
+	for _, r := range records {
+		dst = append(append(dst, trimNL(r.Data)...), '\n')
+	}
+	return dst, nil
+}
+
+type esBulkFraming struct {
+	action []byte
+}
+
+// ESBulkFraming returns an HTTPFraming for the Elasticsearch _bulk
+// API that adds each JSON record to index with a create action, as
+// data streams require. If index is empty the one in the URL is
+// used. Items that fail are reported as a *PartialBatchError, and
+// counted as dropped, though the rest of the batch is kept by
+// Elasticsearch and not resent.
+func ESBulkFraming(index string) HTTPFraming {
+	action := []byte(`{"create":{}}`)
+	if index != "" {
+		action = appendJSONString([]byte(`{"create":{"_index":`), index)
+		action = append(action, "}}"...)
+	}
+	return &esBulkFraming{action: append(action, '\n')}
+}
+
+func (o *esBulkFraming) ContentType() string { return "application/x-ndjson" }
+
+func (o *esBulkFraming) AppendBody(dst []byte, records []HTTPRecord) ([]byte, error) {
+	for _, r := range records {
+		dst = append(dst, o.action...)
+		dst = append(append(dst, trimNL(r.Data)...), '\n')
+	}
+	return dst, nil
+}
+
+func (o *esBulkFraming) CheckResponse(body []byte) error {
+	var resp struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.Errors {
+		return nil
+	}
+	n := 0
+	var first json.RawMessage
+	for _, item := range resp.Items {
+		for _, r := range item {
+			if r.Status/100 != 2 {
+				if n == 0 {
+					first = r.Error
+				}
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return &PartialBatchError{Failed: n, Total: len(resp.Items), Err: fmt.Errorf("first: %s", first)}
+}
+
+// SplunkHECOpts sets the Splunk HTTP Event Collector metadata sent
+// with each event. Empty fields are left to the token's defaults.
+type SplunkHECOpts struct {
+	Host       string
+	Source     string
+	SourceType string
+	Index      string
+}
+
+type splunkHECFraming struct {
+	meta []byte
+}
+
+// SplunkHECFraming returns an HTTPFraming for the Splunk HTTP Event
+// Collector event endpoint (/services/collector/event). JSON object
+// records are sent as structured events, others as strings. The
+// token goes in an "Authorization: Splunk <token>" header.
+func SplunkHECFraming(opts SplunkHECOpts) HTTPFraming {
+	var meta []byte
+	for _, f := range []struct{ k, v string }{
+		{"host", opts.Host}, {"source", opts.Source},
+		{"sourcetype", opts.SourceType}, {"index", opts.Index},
+	} {
+		if f.v != "" {
+			meta = append(meta, ",\""+f.k+"\":"...)
+			meta = appendJSONString(meta, f.v)
+		}
+	}
+	return &splunkHECFraming{meta: meta}
+}
+
+func (o *splunkHECFraming) ContentType() string { return "application/json" }
+
+func (o *splunkHECFraming) AppendBody(dst []byte, records []HTTPRecord) ([]byte, error) {
+	for _, r := range records {
+		d := trimNL(r.Data)
+		dst = append(dst, `{"time":`...)
+		dst = strconv.AppendFloat(dst, float64(r.Time.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64)
+		dst = append(dst, o.meta...)
+		dst = append(dst, `,"event":`...)
+		if t := bytes.TrimSpace(d); len(t) > 0 && t[0] == '{' && json.Valid(t) {
+			dst = append(dst, t...)
+		} else {
+			dst = appendJSONString(dst, string(d))
+		}
+		dst = append(dst, "}\n"...)
+	}
+	return dst, nil
+}
+
+type lokiFraming struct {
+	stream []byte
+}
+
+// LokiFraming returns an HTTPFraming for the Grafana Loki push API
+// (/loki/api/v1/push) that sends each record as a line in the
+// stream with the given labels, timestamped when it was written.
+func LokiFraming(labels map[string]string) HTTPFraming {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	stream := []byte(`{"streams":[{"stream":{`)
+	for i, k := range keys {
+		if i > 0 {
+			stream = append(stream, ',')
+		}
+		stream = appendJSONString(stream, k)
+		stream = append(stream, ':')
+		stream = appendJSONString(stream, labels[k])
+	}
+	stream = append(stream, `},"values":[`...)
+	return &lokiFraming{stream: stream}
+}
+
+func (o *lokiFraming) ContentType() string { return "application/json" }
+
+func (o *lokiFraming) AppendBody(dst []byte, records []HTTPRecord) ([]byte, error) {
+	dst = append(dst, o.stream...)
+	for i, r := range records {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `["`...)
+		dst = strconv.AppendInt(dst, r.Time.UnixNano(), 10)
+		dst = append(dst, `",`...)
+		dst = appendJSONString(dst, string(trimNL(r.Data)))
+		dst = append(dst, ']')
+	}
+	return append(dst, "]}]}"...), nil
+}
@@ -0,0 +1,156 @@
+package logfu
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/msample/log2"
+)
+
+// JournaldSocket is the journald native protocol socket
+const JournaldSocket = "/run/systemd/journal/socket"
+
+// journaldPriorities maps level names to syslog priorities
+var journaldPriorities = map[string]int{
+	"error": 3,
+	"warn":  4,
+	"audit": 5,
+	"info":  6,
+	"debug": 7,
+}
+
+// JournaldOpts configures the Serializer returned by
+// JournaldSerializerFac.
+type JournaldOpts struct {
+	// Identifier is the SYSLOG_IDENTIFIER. Defaults to the program
+	// name.
+	Identifier string
+
+	// MsgKey's value is the MESSAGE. Defaults to "msg".
+	MsgKey string
+
+	// LevelKey's value sets the PRIORITY, which is 6 (info) for
+	// records without it, when the serializer isn't called by a
+	// Config's log func, which gives it the level. Defaults to
+	// LevelKey.
+	LevelKey string
+}
+
+// JournaldSerializerFac returns a SerializerFac for the journald
+// native protocol, for use with JournaldWriterFac. Keys become
+// journal field names: upper cased, with characters other than A-Z,
+// 0-9 and _ replaced by _, leading underscores (reserved for trusted
+// fields) removed, an F prefix added if they'd start with a digit and
+// cut to 64 characters. Values with newlines are written in the
+// protocol's length-prefixed form.
+func JournaldSerializerFac(opts JournaldOpts) func() (Serializer, error) {
+	if opts.Identifier == "" {
+		opts.Identifier = filepath.Base(os.Args[0])
+	}
+	if opts.MsgKey == "" {
+		opts.MsgKey = "msg"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	return func() (Serializer, error) {
+		return &journaldSerializer{opts}, nil
+	}
+}
+
+type journaldSerializer struct {
+	opts JournaldOpts
+}
+
+func (o *journaldSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	return o.serialize(w, keyvals, -1)
+}
+
+func (o *journaldSerializer) SerializeLevel(level log2.Level, w io.Writer, keyvals []interface{}) error {
+	pri, ok := journaldPriorities[LevelName(level)]
+	if !ok {
+		pri = journaldPriorities["info"]
+	}
+	return o.serialize(w, keyvals, pri)
+}
+
+// serialize writes keyvals with priority pri, or the one for the
+// LevelKey keyval if pri is negative
+func (o *journaldSerializer) serialize(w io.Writer, keyvals []interface{}, pri int) error {
+	bp := getBuf()
+	defer putBuf(bp)
+	b := (*bp)[:0]
+	keyPri := journaldPriorities["info"]
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch k {
+		case o.opts.MsgKey:
+			k = "MESSAGE"
+		case o.opts.LevelKey:
+			if p, ok := journaldPriorities[valueString(v)]; ok {
+				keyPri = p
+			}
+		}
+		b = appendJournaldField(b, journaldKey(k), valueString(v))
+	}
+	if pri < 0 {
+		pri = keyPri
+	}
+	b = appendJournaldField(b, "PRIORITY", strconv.Itoa(pri))
+	b = appendJournaldField(b, "SYSLOG_IDENTIFIER", o.opts.Identifier)
+	*bp = b
+	_, err := w.Write(b)
+	return err
+}
+
+// journaldKey makes k a valid journal field name
+func journaldKey(k string) string {
+	k = strings.TrimLeft(strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, k), "_")
+	if k == "" {
+		return "FIELD"
+	}
+	if k[0] >= '0' && k[0] <= '9' {
+		k = "F" + k
+	}
+	if len(k) > 64 {
+		k = k[:64]
+	}
+	return k
+}
+
+func appendJournaldField(b []byte, k, v string) []byte {
+	b = append(b, k...)
+	if strings.IndexByte(v, '\n') < 0 {
+		b = append(b, '=')
+		b = append(b, v...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(v)))
+	b = append(b, v...)
+	return append(b, '\n')
+}
+
+// JournaldWriterFac returns a WriterFac for a JournaldWriter sending
+// to the socket at path, JournaldSocket if empty.
+func JournaldWriterFac(path string) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewJournaldWriter(path)
+	}
+}
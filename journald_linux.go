@@ -0,0 +1,129 @@
+package logfu
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// JournaldWriter sends each Write, a record from a journald
+// Serializer, as a datagram to journald. Records too big for a
+// datagram are written to a sealed memfd, or an unlinked file in
+// /dev/shm where memfd isn't available, and its descriptor sent
+// instead, as sd_journal_send does. Safe for concurrent use.
+type JournaldWriter struct {
+	mutex sync.Mutex
+	conn  *net.UnixConn
+}
+
+// NewJournaldWriter returns a JournaldWriter sending to the socket at
+// path, JournaldSocket if empty.
+func NewJournaldWriter(path string) (*JournaldWriter, error) {
+	if path == "" {
+		path = JournaldSocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldWriter{conn: conn}, nil
+}
+
+func (o *JournaldWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	_, err := o.conn.Write(p)
+	if err == nil {
+		return len(p), nil
+	}
+	if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return 0, err
+	}
+	f, err := journaldFile(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// net refuses WriteMsgUnix on connected datagram sockets
+	rc, err := o.conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	oob := syscall.UnixRights(int(f.Fd()))
+	werr := rc.Write(func(fd uintptr) bool {
+		err = syscall.Sendmsg(int(fd), nil, oob, nil, 0)
+		return err != syscall.EAGAIN
+	})
+	if werr != nil {
+		return 0, werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (o *JournaldWriter) Close() error {
+	return o.conn.Close()
+}
+
+// memfdCreate is the memfd_create syscall number, which package
+// syscall doesn't define for all architectures
+var memfdCreate = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+	fAddSeals       = 1033
+	fSealAll        = 0x1 | 0x2 | 0x4 | 0x8 // seal, shrink, grow, write
+)
+
+// journaldFile returns a file holding p for journald to read
+func journaldFile(p []byte) (*os.File, error) {
+	if nr, ok := memfdCreate[runtime.GOARCH]; ok {
+		name := []byte("logfu-journal\x00")
+		fd, _, errno := syscall.Syscall(nr, uintptr(unsafe.Pointer(&name[0])),
+			mfdCloexec|mfdAllowSealing, 0)
+		if errno == 0 {
+			f := os.NewFile(fd, "memfd:logfu-journal")
+			if _, err := f.Write(p); err != nil {
+				f.Close()
+				return nil, err
+			}
+			if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, fSealAll); errno != 0 {
+				f.Close()
+				return nil, errno
+			}
+			return f, nil
+		}
+	}
+	f, err := os.CreateTemp("/dev/shm", "logfu-journal-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
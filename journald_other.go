@@ -0,0 +1,17 @@
+//go:build !linux
+
+package logfu
+
+import "errors"
+
+// JournaldWriter is only available on Linux.
+type JournaldWriter struct{}
+
+// NewJournaldWriter fails on platforms without journald.
+func NewJournaldWriter(path string) (*JournaldWriter, error) {
+	return nil, errors.New("journald: not supported on this platform")
+}
+
+func (o *JournaldWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("journald: not supported on this platform")
+}
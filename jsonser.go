@@ -0,0 +1,303 @@
+package logfu
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// FastJSONSerializerFac is a factory for FastJSON Serializers
+func FastJSONSerializerFac() (Serializer, error) {
+	return SerializerFunc(FastJSONSerialize), nil
+}
+
+// FastJSONSerialize writes the keyvals as a single line JSON object
+// like JSONSerialize but without building a map or logger per call.
+// Keys are written in keyval order, duplicates included. Strings,
+// bools, ints, uints, floats, time.Time, time.Duration, error and
+// []byte values are encoded directly, anything else with
+// encoding/json. Values are rendered the same as JSONSerialize:
+// errors and fmt.Stringers by their strings, []byte as base64 and
+// nil pointer Marshalers as null. The exception is NaN and infinite
+// floats, which are written as the strings "NaN", "+Inf" and "-Inf"
+// where JSONSerialize fails the record.
+func FastJSONSerialize(w io.Writer, kvs []interface{}) error {
+	bp := getBuf()
+	defer putBuf(bp)
+
+	b, err := appendJSONObject((*bp)[:0], kvs)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	*bp = b
+	_, err = w.Write(b)
+	return err
+}
+
+// serialization buffers are pooled; oversized ones are left for
+// the GC so one huge record doesn't pin memory.
+const maxPooledBuf = 64 << 10
+
+var bufPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, 0, 1024)
+	return &b
+}}
+
+func getBuf() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) <= maxPooledBuf {
+		bufPool.Put(b)
+	}
+}
+
+// missingValue is the value paired with a trailing key without
+// one, the same as go-kit log.ErrMissingValue
+const missingValue = "(MISSING)"
+
+// appendJSONObject appends the keyvals to dst as a JSON object
+func appendJSONObject(dst []byte, kvs []interface{}) ([]byte, error) {
+	var err error
+	dst = append(dst, '{')
+	for i := 0; i < len(kvs); i += 2 {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, keyString(kvs[i]))
+		dst = append(dst, ':')
+		if i+1 < len(kvs) {
+			dst, err = appendJSONValue(dst, kvs[i+1])
+			if err != nil {
+				return dst, err
+			}
+		} else {
+			dst = appendJSONString(dst, missingValue)
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// keyString converts a key to a string the way go-kit does
+func keyString(k interface{}) string {
+	switch x := k.(type) {
+	case string:
+		return x
+	case fmt.Stringer:
+		return safeString(x)
+	}
+	return fmt.Sprint(k)
+}
+
+// safeString returns s.String(), or "NULL" if s is a nil pointer
+// whose String() panics.
+func safeString(s fmt.Stringer) (rv string) {
+	defer func() {
+		if p := recover(); p != nil {
+			if v := reflect.ValueOf(s); v.Kind() == reflect.Ptr && v.IsNil() {
+				rv = "NULL"
+				return
+			}
+			panic(p)
+		}
+	}()
+	return s.String()
+}
+
+// safeError is safeString for errors
+func safeError(e error) (rv string) {
+	defer func() {
+		if p := recover(); p != nil {
+			if v := reflect.ValueOf(e); v.Kind() == reflect.Ptr && v.IsNil() {
+				rv = "NULL"
+				return
+			}
+			panic(p)
+		}
+	}()
+	return e.Error()
+}
+
+// isNilPtr reports whether v is a nil pointer, whose value receiver
+// methods would panic
+func isNilPtr(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && rv.IsNil()
+}
+
+// appendJSONValue appends v's JSON encoding to dst
+func appendJSONValue(dst []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case string:
+		return appendJSONString(dst, x), nil
+	case bool:
+		return strconv.AppendBool(dst, x), nil
+	case int:
+		return strconv.AppendInt(dst, int64(x), 10), nil
+	case int8:
+		return strconv.AppendInt(dst, int64(x), 10), nil
+	case int16:
+		return strconv.AppendInt(dst, int64(x), 10), nil
+	case int32:
+		return strconv.AppendInt(dst, int64(x), 10), nil
+	case int64:
+		return strconv.AppendInt(dst, x, 10), nil
+	case uint:
+		return strconv.AppendUint(dst, uint64(x), 10), nil
+	case uint8:
+		return strconv.AppendUint(dst, uint64(x), 10), nil
+	case uint16:
+		return strconv.AppendUint(dst, uint64(x), 10), nil
+	case uint32:
+		return strconv.AppendUint(dst, uint64(x), 10), nil
+	case uint64:
+		return strconv.AppendUint(dst, x, 10), nil
+	case float32:
+		return appendJSONFloat(dst, float64(x), 32), nil
+	case float64:
+		return appendJSONFloat(dst, x, 64), nil
+	case time.Time:
+		dst = append(dst, '"')
+		dst = x.AppendFormat(dst, time.RFC3339Nano)
+		return append(dst, '"'), nil
+	case time.Duration:
+		return appendJSONString(dst, x.String()), nil
+	case []byte:
+		dst = append(dst, '"')
+		dst = appendBase64(dst, x)
+		return append(dst, '"'), nil
+	case json.Marshaler:
+		if isNilPtr(x) {
+			return append(dst, "null"...), nil
+		}
+		b, err := x.MarshalJSON()
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, b...), nil
+	case encoding.TextMarshaler:
+		if isNilPtr(x) {
+			return append(dst, "null"...), nil
+		}
+		b, err := x.MarshalText()
+		if err != nil {
+			return dst, err
+		}
+		return appendJSONString(dst, string(b)), nil
+	case error:
+		return appendJSONString(dst, safeError(x)), nil
+	case fmt.Stringer:
+		return appendJSONString(dst, safeString(x)), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+func appendJSONFloat(dst []byte, f float64, bits int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, `"NaN"`...)
+	case math.IsInf(f, 1):
+		return append(dst, `"+Inf"`...)
+	case math.IsInf(f, -1):
+		return append(dst, `"-Inf"`...)
+	}
+	// same format choice as encoding/json
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) ||
+			bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	n := len(dst)
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		if m := len(dst) - n; m >= 4 && dst[len(dst)-4] == 'e' &&
+			dst[len(dst)-3] == '-' && dst[len(dst)-2] == '0' {
+			dst[len(dst)-2] = dst[len(dst)-1]
+			dst = dst[:len(dst)-1]
+		}
+	}
+	return dst
+}
+
+// appendBase64 appends the std base64 encoding of b to dst
+func appendBase64(dst, b []byte) []byte {
+	n := base64.StdEncoding.EncodedLen(len(b))
+	if cap(dst)-len(dst) < n {
+		nd := make([]byte, len(dst), 2*cap(dst)+n)
+		copy(nd, dst)
+		dst = nd
+	}
+	base64.StdEncoding.Encode(dst[len(dst):len(dst)+n], b)
+	return dst[:len(dst)+n]
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s as a quoted JSON string. Invalid UTF-8
+// is replaced with U+FFFD. HTML characters are not escaped.
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
@@ -0,0 +1,55 @@
+package logfu
+
+// LogValuer is implemented by keyval values that are expensive to
+// compute.  Their LogValue method is only called once the record has
+// made it through its Filterer, just before serialization, so records
+// for Nop levels or ones dropped by a filter don't pay for them.
+//
+// Filterers see the LogValuer itself rather than its value.
+type LogValuer interface {
+	LogValue() interface{}
+}
+
+// Lazy adapts a func to a LogValuer, e.g.
+//
+//	log2.Debug("msg", "state", "dump", logfu.Lazy(func() interface{} {
+//		return expensiveDump(s)
+//	}))
+type Lazy func() interface{}
+
+func (o Lazy) LogValue() interface{} {
+	return o()
+}
+
+// maxLazyDepth bounds LogValuers returning LogValuers
+const maxLazyDepth = 8
+
+// resolveLazy returns the given keyvals with any LogValuer values
+// replaced by their values. The given slice is returned as is if it
+// has no LogValuers, otherwise a copy is made.
+func resolveLazy(keyvals []interface{}) []interface{} {
+	var rv []interface{}
+	for i, v := range keyvals {
+		lv, ok := v.(LogValuer)
+		if !ok {
+			continue
+		}
+		if rv == nil {
+			rv = make([]interface{}, len(keyvals))
+			copy(rv, keyvals)
+		}
+		r := lv.LogValue()
+		for j := 0; j < maxLazyDepth; j++ {
+			lv, ok := r.(LogValuer)
+			if !ok {
+				break
+			}
+			r = lv.LogValue()
+		}
+		rv[i] = r
+	}
+	if rv == nil {
+		return keyvals
+	}
+	return rv
+}
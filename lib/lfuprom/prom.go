@@ -0,0 +1,128 @@
+// Package lfuprom exports a logfu.Metrics as Prometheus metrics:
+// records logged, filtered out and failing serialization per level,
+// writes, bytes, write errors and write latency per writer, level and
+// mode, records dropped by asynchronous writers, the current mode and
+// the number of mode changes.
+//
+// It is a separate package so logfu itself doesn't depend on the
+// Prometheus client. Register a Collector with your registry, or
+// serve Handler, which uses a registry of its own.
+package lfuprom
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/msample/logfu"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Opts configures a Collector.
+type Opts struct {
+	// Namespace prefixes the metric names. Defaults to "logfu".
+	Namespace string
+
+	// ConstLabels are added to every metric, e.g. to tell the
+	// Configs of a process apart.
+	ConstLabels prometheus.Labels
+}
+
+// Collector is a prometheus.Collector for a logfu.Metrics. Each
+// scrape takes one Snapshot.
+type Collector struct {
+	m *logfu.Metrics
+
+	logged      *prometheus.Desc
+	filtered    *prometheus.Desc
+	serErrors   *prometheus.Desc
+	writes      *prometheus.Desc
+	bytes       *prometheus.Desc
+	writeErrors *prometheus.Desc
+	latency     *prometheus.Desc
+	dropped     *prometheus.Desc
+	mode        *prometheus.Desc
+	modeChanges *prometheus.Desc
+}
+
+// NewCollector returns a Collector for m
+func NewCollector(m *logfu.Metrics, opts Opts) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "logfu"
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, "", name), help, labels, opts.ConstLabels)
+	}
+	wl := []string{"writer", "level", "mode"}
+	return &Collector{
+		m:           m,
+		logged:      desc("records_logged_total", "Log calls, including ones filtered out.", "level"),
+		filtered:    desc("records_filtered_total", "Records removed by a filterer.", "level"),
+		serErrors:   desc("serialization_errors_total", "Serializer errors other than write errors.", "level"),
+		writes:      desc("writes_total", "Records written, including failed writes.", wl...),
+		bytes:       desc("written_bytes_total", "Bytes written.", wl...),
+		writeErrors: desc("write_errors_total", "Failed writes.", wl...),
+		latency:     desc("write_duration_seconds", "Write latency.", wl...),
+		dropped:     desc("records_dropped_total", "Records dropped by asynchronous writers after being written.", "writer"),
+		mode:        desc("mode", "Index of the current logging mode."),
+		modeChanges: desc("mode_changes_total", "Mode changes and reloads."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (o *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{o.logged, o.filtered, o.serErrors, o.writes,
+		o.bytes, o.writeErrors, o.latency, o.dropped, o.mode, o.modeChanges} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (o *Collector) Collect(ch chan<- prometheus.Metric) {
+	s := o.m.Snapshot()
+	counter := func(d *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(v), labels...)
+	}
+	for _, l := range s.Levels {
+		counter(o.logged, l.Logged, l.Level)
+		counter(o.filtered, l.Filtered, l.Level)
+		counter(o.serErrors, l.SerializeErrors, l.Level)
+	}
+	for _, w := range s.Writers {
+		wi, mode := strconv.Itoa(w.Writer), strconv.Itoa(w.Mode)
+		counter(o.writes, w.Records, wi, w.Level, mode)
+		counter(o.bytes, w.Bytes, wi, w.Level, mode)
+		counter(o.writeErrors, w.Errors, wi, w.Level, mode)
+
+		// prometheus buckets are cumulative; the last,
+		// unbounded, one is the count
+		buckets := make(map[float64]uint64, len(logfu.LatencyBuckets))
+		var n uint64
+		for i, c := range w.Latency {
+			n += c
+			if i < len(logfu.LatencyBuckets) {
+				buckets[logfu.LatencyBuckets[i].Seconds()] = n
+			}
+		}
+		ch <- prometheus.MustNewConstHistogram(o.latency, n, w.LatencySum.Seconds(), buckets, wi, w.Level, mode)
+	}
+	for i, n := range s.Dropped {
+		counter(o.dropped, n, strconv.Itoa(i))
+	}
+	ch <- prometheus.MustNewConstMetric(o.mode, prometheus.GaugeValue, float64(s.Mode))
+	counter(o.modeChanges, s.ModeChanges)
+}
+
+// Register registers a Collector for m, with default Opts, with r,
+// e.g. prometheus.DefaultRegisterer.
+func Register(r prometheus.Registerer, m *logfu.Metrics) error {
+	return r.Register(NewCollector(m, Opts{}))
+}
+
+// Handler returns an http.Handler serving m's metrics, alone, in the
+// Prometheus exposition formats, text by default.
+func Handler(m *logfu.Metrics, opts Opts) http.Handler {
+	r := prometheus.NewRegistry()
+	r.MustRegister(NewCollector(m, opts))
+	return promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+}
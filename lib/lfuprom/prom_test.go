@@ -0,0 +1,91 @@
+package lfuprom_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/msample/log2"
+	"github.com/msample/logfu"
+	"github.com/msample/logfu/lib/lfuprom"
+)
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	// drops "skip" records and fails to serialize "bad" ones
+	filterFac := func() (logfu.Filterer, error) {
+		return logfu.FilterFunc(func(kv []interface{}) ([]interface{}, error) {
+			if kv[1] == "skip" {
+				return nil, nil
+			}
+			return kv, nil
+		}), nil
+	}
+	serializerFac := func() (logfu.Serializer, error) {
+		s, err := logfu.LogfmtSerializerFac()
+		return logfu.SerializerFunc(func(w io.Writer, kv []interface{}) error {
+			if kv[1] == "bad" {
+				return errors.New("can't serialize")
+			}
+			return s.Serialize(w, kv)
+		}), err
+	}
+	var hw *logfu.HTTPWriter
+	writerFac := func() (io.Writer, error) {
+		var err error
+		hw, err = logfu.NewHTTPWriter(logfu.HTTPOpts{URL: srv.URL, Retries: -1})
+		return hw, err
+	}
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{filterFac},
+		[]logfu.SerializerFac{serializerFac},
+		[]logfu.WriterFac{writerFac},
+		[]logfu.Mode{{log2.ERROR: []logfu.Fsw{{FilterInd: 0, SerializerInd: 0, WriterInd: 0}}}, {}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := logfu.NewMetrics()
+	lf.SetMetrics(m)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	defer lf.ChangeToMode(1, false, false)
+
+	log2.Error("msg", "ok")
+	log2.Error("msg", "skip")
+	log2.Error("msg", "bad")
+	if err := hw.Flush(); err == nil {
+		t.Error("expected the batch to be dropped")
+	}
+
+	rec := httptest.NewRecorder()
+	lfuprom.Handler(m, lfuprom.Opts{ConstLabels: map[string]string{"app": "test"}}).
+		ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text exposition format, got %q", ct)
+	}
+	body := rec.Body.String()
+	for _, s := range []string{
+		`logfu_records_logged_total{app="test",level="error"} 3`,
+		`logfu_records_filtered_total{app="test",level="error"} 1`,
+		`logfu_serialization_errors_total{app="test",level="error"} 1`,
+		`logfu_writes_total{app="test",level="error",mode="0",writer="0"} 1`,
+		`logfu_write_errors_total{app="test",level="error",mode="0",writer="0"} 0`,
+		`logfu_write_duration_seconds_count{app="test",level="error",mode="0",writer="0"} 1`,
+		`logfu_records_dropped_total{app="test",writer="0"} 1`,
+		`logfu_mode{app="test"} 0`,
+		`logfu_mode_changes_total{app="test"} 1`,
+	} {
+		if !strings.Contains(body, s+"\n") {
+			t.Errorf("expected %q in\n%v", s, body)
+		}
+	}
+}
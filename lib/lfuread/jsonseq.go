@@ -0,0 +1,152 @@
+package lfuread
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+const rs = 0x1e
+
+// JSONSeqReader reads RFC 7464 JSON text sequences, as written by
+// logfu.RSWriter. Texts that are truncated, e.g. by a crash part way
+// through a write, or otherwise don't parse are skipped, as the RFC
+// allows, and counted.
+type JSONSeqReader struct {
+	r         *bufio.Reader
+	started   bool
+	truncated int
+}
+
+// NewJSONSeqReader returns a JSONSeqReader reading from r
+func NewJSONSeqReader(r io.Reader) *JSONSeqReader {
+	return &JSONSeqReader{r: bufio.NewReader(r)}
+}
+
+// Truncated returns the number of texts skipped so far
+func (o *JSONSeqReader) Truncated() int {
+	return o.truncated
+}
+
+// NextRaw returns the next complete JSON text, without its framing.
+// It returns io.EOF when there are no more.
+func (o *JSONSeqReader) NextRaw() (json.RawMessage, error) {
+	if !o.started {
+		// anything before the first RS is the tail of a text
+		// we don't have the start of
+		pre, err := o.r.ReadBytes(rs)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		o.started = true
+		if len(bytes.TrimSpace(bytes.TrimSuffix(pre, []byte{rs}))) > 0 {
+			o.truncated++
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+	for {
+		text, err := o.r.ReadBytes(rs)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(text) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		text = bytes.TrimSuffix(text, []byte{rs})
+		if t := bytes.TrimSpace(text); len(t) > 0 {
+			if complete(text, t) {
+				return json.RawMessage(t), nil
+			}
+			o.truncated++
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+}
+
+// complete reports whether text, t trimmed, is a whole JSON text.
+// Per RFC 7464 section 2.4 numbers, true, false and null must be
+// followed by whitespace as they could be cut short and still parse.
+func complete(text, t []byte) bool {
+	if !json.Valid(t) {
+		return false
+	}
+	switch t[0] {
+	case '{', '[', '"':
+		return true
+	}
+	return len(text) > len(t) && text[len(text)-1] <= ' '
+}
+
+// Next returns the next record's keyvals, in the order they were
+// written. It returns ErrNotRecord for texts that aren't JSON
+// objects and io.EOF when there are no more records. Numbers decode
+// to int64 if they are integers that fit, float64 otherwise.
+func (o *JSONSeqReader) Next() ([]interface{}, error) {
+	raw, err := o.NextRaw()
+	if err != nil {
+		return nil, err
+	}
+	if raw[0] != '{' {
+		return nil, ErrNotRecord
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	dec.Token() // {
+	var rv []interface{}
+	for dec.More() {
+		k, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		rv = append(rv, k, numbers(v))
+	}
+	return rv, nil
+}
+
+// ReadAll returns all the remaining records, skipping texts that
+// aren't JSON objects
+func (o *JSONSeqReader) ReadAll() ([][]interface{}, error) {
+	var rv [][]interface{}
+	for {
+		kv, err := o.Next()
+		switch err {
+		case nil:
+			rv = append(rv, kv)
+		case ErrNotRecord:
+		case io.EOF:
+			return rv, nil
+		default:
+			return rv, err
+		}
+	}
+}
+
+// numbers replaces json.Numbers in v with int64s or float64s
+func numbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case []interface{}:
+		for i := range x {
+			x[i] = numbers(x[i])
+		}
+	case map[string]interface{}:
+		for k := range x {
+			x[k] = numbers(x[k])
+		}
+	}
+	return v
+}
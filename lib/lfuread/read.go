@@ -0,0 +1,394 @@
+// Package lfuread reads back the records written by the logfu
+// MessagePack and CBOR serializers and by JSON serializers through
+// logfu.RSWriter, e.g. for tooling and tests.
+//
+// Each record decodes to its keyvals in the order they were
+// written. Values decode to nil, bool, int64, uint64 (only for
+// integers above math.MaxInt64), float32, float64, string, []byte,
+// time.Time, []interface{} and map[string]interface{}.
+package lfuread
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// maxLen bounds string, array and map lengths so a corrupt length
+// can't allocate unbounded memory
+const maxLen = 64 << 20
+
+// maxPrealloc bounds the elements allocated for an array or map
+// before they are read, so a corrupt length fails on the short
+// stream rather than allocating for maxLen elements
+const maxPrealloc = 64
+
+func capHint(n uint64) int {
+	if n > maxPrealloc {
+		return maxPrealloc
+	}
+	return int(n)
+}
+
+// maxDepth bounds nesting
+const maxDepth = 64
+
+// ErrNotRecord is returned when the next value in the stream is not
+// a map and so not a logfu record
+var ErrNotRecord = errors.New("value is not a keyval map")
+
+// Reader reads records from a MessagePack or CBOR stream
+type Reader struct {
+	r    *bufio.Reader
+	cbor bool
+}
+
+// NewMsgpackReader returns a Reader for records written by
+// logfu.MsgpackSerialize
+func NewMsgpackReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// NewCBORReader returns a Reader for records written by
+// logfu.CBORSerialize
+func NewCBORReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r), cbor: true}
+}
+
+// Next returns the next record's keyvals. It returns io.EOF when
+// there are no more records, and io.ErrUnexpectedEOF if the stream
+// ends part way through one.
+func (o *Reader) Next() ([]interface{}, error) {
+	if _, err := o.r.Peek(1); err != nil {
+		return nil, err
+	}
+	var n int
+	var err error
+	if o.cbor {
+		n, err = o.cborMapHead()
+	} else {
+		n, err = o.msgpackMapHead()
+	}
+	if err != nil {
+		return nil, eof(err)
+	}
+	rv := make([]interface{}, 0, capHint(2*uint64(n)))
+	for i := 0; i < 2*n; i++ {
+		v, err := o.value(0)
+		if err != nil {
+			return nil, eof(err)
+		}
+		rv = append(rv, v)
+	}
+	return rv, nil
+}
+
+// ReadAll returns all the remaining records
+func (o *Reader) ReadAll() ([][]interface{}, error) {
+	var rv [][]interface{}
+	for {
+		kv, err := o.Next()
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return rv, err
+		}
+		rv = append(rv, kv)
+	}
+}
+
+// eof converts EOF part way through a record to ErrUnexpectedEOF
+func eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (o *Reader) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("values nested more than %v deep", maxDepth)
+	}
+	if o.cbor {
+		return o.cborValue(depth)
+	}
+	return o.msgpackValue(depth)
+}
+
+func (o *Reader) readN(n uint64) ([]byte, error) {
+	if n > maxLen {
+		return nil, fmt.Errorf("length %v too large", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(o.r, b)
+	return b, err
+}
+
+func (o *Reader) uintN(size int) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(o.r, b[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+func (o *Reader) array(n uint64, depth int) ([]interface{}, error) {
+	if n > maxLen {
+		return nil, fmt.Errorf("length %v too large", n)
+	}
+	rv := make([]interface{}, 0, capHint(n))
+	for i := uint64(0); i < n; i++ {
+		v, err := o.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, v)
+	}
+	return rv, nil
+}
+
+func (o *Reader) object(n uint64, depth int) (map[string]interface{}, error) {
+	if n > maxLen {
+		return nil, fmt.Errorf("length %v too large", n)
+	}
+	rv := make(map[string]interface{}, capHint(n))
+	for i := uint64(0); i < n; i++ {
+		k, err := o.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := o.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		rv[fmt.Sprint(k)] = v
+	}
+	return rv, nil
+}
+
+// MessagePack
+
+func (o *Reader) msgpackMapHead() (int, error) {
+	c, err := o.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch {
+	case c&0xf0 == 0x80:
+		n = uint64(c & 0x0f)
+	case c == 0xde:
+		n, err = o.uintN(2)
+	case c == 0xdf:
+		n, err = o.uintN(4)
+	default:
+		return 0, ErrNotRecord
+	}
+	if n > maxLen {
+		return 0, fmt.Errorf("length %v too large", n)
+	}
+	return int(n), err
+}
+
+func (o *Reader) msgpackValue(depth int) (interface{}, error) {
+	c, err := o.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		b, err := o.readN(uint64(c & 0x1f))
+		return string(b), err
+	case c&0xf0 == 0x90:
+		return o.array(uint64(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return o.object(uint64(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		// as int64 when it fits, like positive fixints and CBOR
+		u, err := o.uintN(1 << (c - 0xcc))
+		if u <= math.MaxInt64 {
+			return int64(u), err
+		}
+		return u, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := o.uintN(size)
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, err
+	case 0xca:
+		u, err := o.uintN(4)
+		return math.Float32frombits(uint32(u)), err
+	case 0xcb:
+		u, err := o.uintN(8)
+		return math.Float64frombits(u), err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		var size int
+		switch c {
+		case 0xd9, 0xc4:
+			size = 1
+		case 0xda, 0xc5:
+			size = 2
+		default:
+			size = 4
+		}
+		n, err := o.uintN(size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := o.readN(n)
+		if c >= 0xd9 {
+			return string(b), err
+		}
+		return b, err
+	case 0xdc, 0xdd:
+		n, err := o.uintN(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return o.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := o.uintN(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return o.object(n, depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return o.msgpackExt(uint64(1) << (c - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := o.uintN(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return o.msgpackExt(n)
+	}
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%02x", c)
+}
+
+// msgpackExt decodes the timestamp extension; other extensions are
+// returned as their raw data
+func (o *Reader) msgpackExt(n uint64) (interface{}, error) {
+	t, err := o.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.readN(n)
+	if err != nil || int8(t) != -1 {
+		return b, err
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case 8:
+		u := binary.BigEndian.Uint64(b)
+		return time.Unix(int64(u&(1<<34-1)), int64(u>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(b[4:])), int64(binary.BigEndian.Uint32(b))), nil
+	}
+	return nil, fmt.Errorf("bad MessagePack timestamp length %v", n)
+}
+
+// CBOR
+
+// cborArg reads the argument for the given initial byte
+func (o *Reader) cborArg(c byte) (uint64, error) {
+	switch info := c & 0x1f; {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return o.uintN(1 << (info - 24))
+	}
+	return 0, fmt.Errorf("unsupported CBOR argument 0x%02x", c)
+}
+
+func (o *Reader) cborMapHead() (int, error) {
+	c, err := o.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if c>>5 != 5 {
+		return 0, ErrNotRecord
+	}
+	n, err := o.cborArg(c)
+	if n > maxLen {
+		return 0, fmt.Errorf("length %v too large", n)
+	}
+	return int(n), err
+}
+
+func (o *Reader) cborValue(depth int) (interface{}, error) {
+	c, err := o.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	major := c >> 5
+	if major == 7 {
+		switch c {
+		case 0xf4:
+			return false, nil
+		case 0xf5:
+			return true, nil
+		case 0xf6, 0xf7:
+			return nil, nil
+		case 0xfa:
+			u, err := o.uintN(4)
+			return math.Float32frombits(uint32(u)), err
+		case 0xfb:
+			u, err := o.uintN(8)
+			return math.Float64frombits(u), err
+		}
+		return nil, fmt.Errorf("unsupported CBOR simple value 0x%02x", c)
+	}
+	n, err := o.cborArg(c)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("CBOR negative int overflows int64")
+		}
+		return -1 - int64(n), nil
+	case 2:
+		return o.readN(n)
+	case 3:
+		b, err := o.readN(n)
+		return string(b), err
+	case 4:
+		return o.array(n, depth)
+	case 5:
+		return o.object(n, depth)
+	}
+	// tags: 0 is a date/time string, others pass their content
+	// through
+	v, err := o.value(depth + 1)
+	if err != nil || n != 0 {
+		return v, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("CBOR tag 0 content is not a string")
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
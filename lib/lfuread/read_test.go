@@ -0,0 +1,172 @@
+package lfuread_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/msample/logfu"
+	"github.com/msample/logfu/lib/lfuread"
+)
+
+func TestRoundTrip(t *testing.T) {
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 123456789, time.UTC)
+	in := []interface{}{
+		"msg", "hello", "n", 42, "neg", -5, "big", int64(-1 << 40), "u", uint64(math.MaxUint64),
+		"u8", uint8(200), "u32", uint32(70000), "text", textOnly{}, "niltext", (*textOnly)(nil),
+		"f", 1.5, "f32", float32(0.25), "ok", true, "nil", nil, "ts", ts,
+		"old", time.Unix(-1, 0).UTC(), "d", time.Second, "err", errors.New("boom"),
+		"b", []byte{1, 2, 3}, "long", string(bytes.Repeat([]byte("x"), 300)),
+		"list", []int{1, 2}, "map", map[string]int{"a": 1}, "odd",
+	}
+	want := []interface{}{
+		"msg", "hello", "n", int64(42), "neg", int64(-5), "big", int64(-1 << 40), "u", uint64(math.MaxUint64),
+		"u8", int64(200), "u32", int64(70000), "text", "text", "niltext", nil,
+		"f", 1.5, "f32", float32(0.25), "ok", true, "nil", nil, "ts", ts,
+		"old", time.Unix(-1, 0).UTC(), "d", "1s", "err", "boom",
+		"b", []byte{1, 2, 3}, "long", string(bytes.Repeat([]byte("x"), 300)),
+		"list", []interface{}{int64(1), int64(2)}, "map", map[string]interface{}{"a": int64(1)},
+		"odd", "(MISSING)",
+	}
+
+	for _, tc := range []struct {
+		name      string
+		serialize logfu.SerializerFunc
+		reader    func(io.Reader) *lfuread.Reader
+	}{
+		{"msgpack", logfu.MsgpackSerialize, lfuread.NewMsgpackReader},
+		{"cbor", logfu.CBORSerialize, lfuread.NewCBORReader},
+	} {
+		var buf bytes.Buffer
+		for i := 0; i < 2; i++ {
+			if err := tc.serialize(&buf, in); err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+		}
+		recs, err := tc.reader(&buf).ReadAll()
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if len(recs) != 2 {
+			t.Fatalf("%v: expected 2 records, got %v", tc.name, len(recs))
+		}
+		got := recs[1]
+		for i := range want {
+			if g, ok := got[i].(time.Time); ok {
+				got[i] = g.UTC()
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v:\ngot  %#v\nwant %#v", tc.name, got, want)
+		}
+	}
+}
+
+// textOnly is an encoding.TextMarshaler but not a fmt.Stringer
+type textOnly struct{}
+
+func (textOnly) MarshalText() ([]byte, error) {
+	return []byte("text"), nil
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	logfu.MsgpackSerialize(&buf, []interface{}{"msg", "hello"})
+	b := buf.Bytes()
+	_, err := lfuread.NewMsgpackReader(bytes.NewReader(b[:len(b)-2])).Next()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+
+	// a corrupt map length fails on the short stream without
+	// allocating for it
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	before := ms.TotalAlloc
+	corrupt := []byte{0xdf, 0x03, 0xff, 0xff, 0xff, 0xa1, 'k'}
+	_, err = lfuread.NewMsgpackReader(bytes.NewReader(corrupt)).Next()
+	runtime.ReadMemStats(&ms)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected ErrUnexpectedEOF, got %v", err)
+	}
+	if n := ms.TotalAlloc - before; n > 1<<20 {
+		t.Errorf("corrupt length allocated %v bytes", n)
+	}
+}
+
+// countWriter counts Write calls
+type countWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (o *countWriter) Write(p []byte) (int, error) {
+	o.writes++
+	return o.Buffer.Write(p)
+}
+
+func TestJSONSeq(t *testing.T) {
+	var buf countWriter
+	w, _ := logfu.RSWriterFac(func() (io.Writer, error) { return &buf, nil })()
+	logfu.FastJSONSerialize(w, []interface{}{"msg", "one", "n", 1})
+	logfu.FastJSONSerialize(w, []interface{}{"msg", "two", "f", 1.5, "big", int64(1) << 60})
+	if buf.writes != 2 {
+		t.Errorf("expected one write per record, got %v", buf.writes)
+	}
+	want := "\x1e{\"msg\":\"one\",\"n\":1}\n\x1e{\"msg\":\"two\",\"f\":1.5,\"big\":1152921504606846976}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	recs, err := lfuread.NewJSONSeqReader(bytes.NewReader(buf.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRecs := [][]interface{}{
+		{"msg", "one", "n", int64(1)},
+		{"msg", "two", "f", 1.5, "big", int64(1) << 60},
+	}
+	if !reflect.DeepEqual(recs, wantRecs) {
+		t.Errorf("got %#v, want %#v", recs, wantRecs)
+	}
+}
+
+func TestJSONSeqRecovery(t *testing.T) {
+	in := "d\":1}\n" + // tail of a record we don't have the start of
+		"\x1e{\"a\":1}\n" +
+		"\x1e{\"b\":\x1e{\"c\":2}\n" + // cut short by a crash
+		"\x1e123\x1e" + // a number cut short could be wrong
+		"\x1e\x1e456\n" + // empty texts are skipped
+		"\x1e{\"d\":"
+	r := lfuread.NewJSONSeqReader(bytes.NewReader([]byte(in)))
+	var got []string
+	for {
+		raw, err := r.NextRaw()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(raw))
+	}
+	if want := []string{`{"a":1}`, `{"c":2}`, `456`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if r.Truncated() != 4 {
+		t.Errorf("expected 4 truncated texts, got %v", r.Truncated())
+	}
+
+	r = lfuread.NewJSONSeqReader(bytes.NewReader([]byte("\x1e[1]\n\x1e{\"a\":1}\n")))
+	if _, err := r.Next(); err != lfuread.ErrNotRecord {
+		t.Errorf("expected ErrNotRecord, got %v", err)
+	}
+	if kv, err := r.Next(); err != nil || !reflect.DeepEqual(kv, []interface{}{"a", int64(1)}) {
+		t.Errorf("unexpected record %v %v", kv, err)
+	}
+}
@@ -0,0 +1,215 @@
+package logfu
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// LogfmtOpts configures the Serializer returned by
+// StrictLogfmtSerializerFac.
+type LogfmtOpts struct {
+	// Pinned keys are written first, in the given order, e.g.
+	// {"ts", "level", "msg"}.
+	Pinned []string
+
+	// Sort writes the keys that aren't pinned in sorted order
+	// rather than keyval order. Keys sort by their flattened name
+	// and duplicates keep their relative order.
+	Sort bool
+
+	// Flatten writes map, slice and array values as one keyval
+	// per element with dotted keys: "req.path", "ids.0". Map
+	// entries are written in key order. Otherwise they are
+	// written in their fmt.Sprint form.
+	Flatten bool
+
+	// FloatFormat and FloatPrec are the strconv.FormatFloat
+	// format and precision for floats. If FloatFormat is zero the
+	// shortest 'g' format is used.
+	FloatFormat byte
+	FloatPrec   int
+
+	// TimeFormat is the time.Format layout for time.Time
+	// values. Defaults to time.RFC3339Nano.
+	TimeFormat string
+}
+
+// StrictLogfmtSerializerFac returns a SerializerFac for logfmt
+// written without go-kit, for output that is the same from run to
+// run given the same keyvals, as golden-file tests need.
+//
+// Keys have spaces, '=', '"' and control characters replaced with
+// '_'. Values are double-quoted, with JSON string escapes, if they
+// are empty or contain spaces, '=', '"', '\' or control
+// characters. Invalid UTF-8 is replaced with U+FFFD, so output is
+// always valid UTF-8 with one record per line.
+func StrictLogfmtSerializerFac(opts LogfmtOpts) func() (Serializer, error) {
+	if opts.TimeFormat == "" {
+		opts.TimeFormat = time.RFC3339Nano
+	}
+	pinned := make(map[string]int)
+	for i, k := range opts.Pinned {
+		if _, ok := pinned[k]; !ok {
+			pinned[k] = i
+		}
+	}
+	return func() (Serializer, error) {
+		return SerializerFunc(func(w io.Writer, keyvals []interface{}) error {
+			return logfmtSerialize(w, keyvals, &opts, pinned)
+		}), nil
+	}
+}
+
+type logfmtField struct {
+	key string
+	val interface{}
+}
+
+func logfmtSerialize(w io.Writer, keyvals []interface{}, o *LogfmtOpts, pinned map[string]int) error {
+	fields := make([]logfmtField, 0, len(keyvals)/2+1)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		k := keyString(keyvals[i])
+		if o.Flatten {
+			fields = flatten(fields, k, v, 0)
+		} else {
+			fields = append(fields, logfmtField{k, v})
+		}
+	}
+
+	// pinned keys first (first occurrence only), then the rest
+	ordered := make([]logfmtField, 0, len(fields))
+	used := make([]bool, len(fields))
+	if len(pinned) > 0 {
+		at := make([]int, len(o.Pinned))
+		for i := range at {
+			at[i] = -1
+		}
+		for i, f := range fields {
+			if p, ok := pinned[f.key]; ok && at[p] < 0 {
+				at[p] = i
+			}
+		}
+		for _, i := range at {
+			if i >= 0 {
+				ordered = append(ordered, fields[i])
+				used[i] = true
+			}
+		}
+	}
+	rest := len(ordered)
+	for i, f := range fields {
+		if !used[i] {
+			ordered = append(ordered, f)
+		}
+	}
+	if o.Sort {
+		r := ordered[rest:]
+		sort.SliceStable(r, func(i, j int) bool { return r[i].key < r[j].key })
+	}
+
+	bp := getBuf()
+	defer putBuf(bp)
+	b := (*bp)[:0]
+	for i, f := range ordered {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = appendLogfmtKey(b, f.key)
+		b = append(b, '=')
+		b = o.appendValue(b, f.val)
+	}
+	b = append(b, '\n')
+	*bp = b
+	_, err := w.Write(b)
+	return err
+}
+
+// flatten appends k, v to fields, expanding maps, slices and arrays
+// into dotted keys
+func flatten(fields []logfmtField, k string, v interface{}, depth int) []logfmtField {
+	if v == nil || depth >= maxBinDepth {
+		return append(fields, logfmtField{k, v})
+	}
+	switch v.(type) {
+	case []byte, error, fmt.Stringer:
+		return append(fields, logfmtField{k, v})
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map:
+		keys := rv.MapKeys()
+		names := make([]string, len(keys))
+		idx := make([]int, len(keys))
+		for i, mk := range keys {
+			names[i] = keyString(mk.Interface())
+			idx[i] = i
+		}
+		sort.Slice(idx, func(i, j int) bool { return names[idx[i]] < names[idx[j]] })
+		for _, i := range idx {
+			fields = flatten(fields, k+"."+names[i], rv.MapIndex(keys[i]).Interface(), depth+1)
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			fields = flatten(fields, k+"."+strconv.Itoa(i), rv.Index(i).Interface(), depth+1)
+		}
+		return fields
+	}
+	return append(fields, logfmtField{k, v})
+}
+
+func appendLogfmtKey(dst []byte, k string) []byte {
+	if k == "" {
+		return append(dst, '_')
+	}
+	for _, r := range k {
+		if r <= ' ' || r == '=' || r == '"' || r == 0x7f || r == utf8.RuneError {
+			r = '_'
+		}
+		dst = utf8.AppendRune(dst, r)
+	}
+	return dst
+}
+
+func (o *LogfmtOpts) appendValue(dst []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case float32:
+		return o.appendFloat(dst, float64(x), 32)
+	case float64:
+		return o.appendFloat(dst, x, 64)
+	case time.Time:
+		return appendLogfmtString(dst, x.Format(o.TimeFormat))
+	case int:
+		return strconv.AppendInt(dst, int64(x), 10)
+	case int64:
+		return strconv.AppendInt(dst, x, 10)
+	case bool:
+		return strconv.AppendBool(dst, x)
+	}
+	return appendLogfmtString(dst, valueString(v))
+}
+
+func (o *LogfmtOpts) appendFloat(dst []byte, f float64, bits int) []byte {
+	switch {
+	case math.IsNaN(f):
+		return append(dst, "NaN"...)
+	case math.IsInf(f, 1):
+		return append(dst, "+Inf"...)
+	case math.IsInf(f, -1):
+		return append(dst, "-Inf"...)
+	}
+	if o.FloatFormat == 0 {
+		return strconv.AppendFloat(dst, f, 'g', -1, bits)
+	}
+	return strconv.AppendFloat(dst, f, o.FloatFormat, o.FloatPrec, bits)
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	// more standards compliant than log/sylog
@@ -39,6 +40,22 @@ type Filterer interface {
 	Filter(inKeyvals []interface{}) (outKeyvals []interface{}, err error)
 }
 
+// LevelFilterer may be implemented by Filterers that treat records
+// differently depending on the level they were logged at. Log funcs
+// call FilterLevel, with their level, instead of Filter.
+type LevelFilterer interface {
+	Filterer
+	FilterLevel(level log2.Level, keyvals []interface{}) ([]interface{}, error)
+}
+
+// LevelWriter may be implemented by Writers that treat records
+// differently depending on the level they were logged at. Log funcs
+// call WriteLevel, with their level, instead of Write.
+type LevelWriter interface {
+	io.Writer
+	WriteLevel(level log2.Level, p []byte) (int, error)
+}
+
 // Serializer converts a series of kv pairs to a single []byte and
 // writes it to the given Writer in a single Write call.  Use a
 // MultiWriter to avoid unecessary re-serialization.
@@ -46,6 +63,15 @@ type Serializer interface {
 	Serialize(w io.Writer, inKeyvals []interface{}) error
 }
 
+// LevelSerializer may be implemented by Serializers that treat
+// records differently depending on the level they were logged at.
+// Log funcs call SerializeLevel, with their level, instead of
+// Serialize.
+type LevelSerializer interface {
+	Serializer
+	SerializeLevel(level log2.Level, w io.Writer, keyvals []interface{}) error
+}
+
 type Config struct {
 	mutex           sync.Mutex
 	filtererFacs    []FiltererFac
@@ -57,6 +83,35 @@ type Config struct {
 	modeVals        *modeVals
 	sigCh           chan os.Signal
 	sigStopCh       chan struct{}
+	dumpSignal      os.Signal
+	levelKey        string
+	metrics         *Metrics
+	logger          *Logger
+	swapped         bool    // log funcs have been swapped into target
+	target          *Logger // nil for log2
+}
+
+// LevelKey is the default key for the level keyval added to records
+// by Config.SetLevelKey, and the key serializers that care about
+// levels look for by default.
+const LevelKey = "level"
+
+// LevelName returns the name used for the given level in level
+// keyvals, e.g. "error"
+func LevelName(l log2.Level) string {
+	switch l {
+	case log2.ERROR:
+		return "error"
+	case log2.WARN:
+		return "warn"
+	case log2.INFO:
+		return "info"
+	case log2.DEBUG:
+		return "debug"
+	case log2.AUDIT:
+		return "audit"
+	}
+	return fmt.Sprintf("level%d", int(l))
 }
 
 // Mode defines a logging configuration by specifying the log levels
@@ -166,15 +221,20 @@ func New(filtererFacs []FiltererFac,
 }
 
 // SignalControlOn makes it so SIG_USR1 calls NextMode, SIG_USR2 calls
-// HomeMode, and SIG_HUP reloads the current log mode.
+// HomeMode, and SIG_HUP reloads the current log mode. The signal set
+// with SetDumpSignal, if any, calls DumpWriters.
 func (o *Config) SignalControlOn() {
 	o.mutex.Lock()
 	defer o.mutex.Unlock()
 
 	o.sigCh = make(chan os.Signal, 32)
 	o.sigStopCh = make(chan struct{})
-	signal.Notify(o.sigCh, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
-	go func(sigCh <-chan os.Signal, doneCh <-chan struct{}) {
+	sigs := []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP}
+	if o.dumpSignal != nil {
+		sigs = append(sigs, o.dumpSignal)
+	}
+	signal.Notify(o.sigCh, sigs...)
+	go func(sigCh <-chan os.Signal, doneCh <-chan struct{}, dumpSig os.Signal) {
 		for {
 			select {
 			case <-doneCh:
@@ -189,10 +249,13 @@ func (o *Config) SignalControlOn() {
 
 				case (syscall.SIGHUP):
 					o.ReloadMode()
+
+				case dumpSig:
+					o.DumpWriters()
 				}
 			}
 		}
-	}(o.sigCh, o.sigStopCh)
+	}(o.sigCh, o.sigStopCh, o.dumpSignal)
 }
 
 // SignalControlOff ceases changing log modes in response to signals
@@ -206,6 +269,66 @@ func (o *Config) SignalControlOff() {
 	o.sigStopCh = nil
 }
 
+// DumpWriters calls Dump on the current mode's writers that are
+// Dumpers, such as RingWriters, returning the first error.
+func (o *Config) DumpWriters() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var rv error
+	for _, w := range o.modeVals.writers {
+		if d, ok := w.(Dumper); ok {
+			if err := d.Dump(); err != nil && rv == nil {
+				rv = err
+			}
+		}
+	}
+	return rv
+}
+
+// SetDumpSignal makes SignalControlOn also call DumpWriters, to dump
+// RingWriters, when the process gets sig, e.g. syscall.SIGTTIN, or
+// not if sig is nil (the default). Use a signal SignalControlOn
+// doesn't already handle. Takes effect at the next SignalControlOn.
+func (o *Config) SetDumpSignal(sig os.Signal) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.dumpSignal = sig
+}
+
+// SetLevelKey makes each record start with a key, LevelName(level)
+// keyval for the level it was logged at, before it reaches its
+// filterer. Use "" to turn it off (the default). Takes effect at the
+// next mode change, so call it before the first ChangeToMode.
+func (o *Config) SetLevelKey(key string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.levelKey = key
+}
+
+// SetMetrics makes the Config count records, writes and mode changes
+// in m, or stop counting if m is nil (the default). Takes effect at
+// the next mode change, so call it before the first ChangeToMode.
+func (o *Config) SetMetrics(m *Metrics) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.metrics = m
+}
+
+// SetLogger makes the Config swap its log funcs into l, rather than
+// the global log2 funcs, or back into log2 if l is nil (the
+// default). Takes effect at the next mode change, so call it before
+// the first ChangeToMode.
+func (o *Config) SetLogger(l *Logger) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.logger = l
+}
+
 // Recreate the current log config by re-creating the filters,
 // serializers and writers and re-swapping them into their log2
 // levels (e.g. in response to HUP)
@@ -276,17 +399,28 @@ func (o *Config) changeToMode(mode int, force, recreate bool) error {
 		return err
 	}
 
+	swap := swapFunc(o.logger)
+	if o.swapped && o.target != o.logger {
+		// the old target would keep logging to the writers closed
+		// below
+		swapNop(swapFunc(o.target), nil)
+	}
+	o.swapped, o.target = true, o.logger
+
 	// swap log funcs to use new modeVals
 	o.currMode = mode
 	o.modeVals = mv
 	for k, v := range o.modes[mode] {
 		// consider providing mutex in log2 to used when
 		// swapping more then one func
-		log2.Swap(k, makeLogFunc(mv, v))
+		swap(k, makeLogFunc(mv, v, k, o.levelKey, o.metrics, mode))
 	}
 
 	// swap nop log in for ones not replaced by this mode
-	swapNop(o.modes[mode])
+	swapNop(swap, o.modes[mode])
+	if o.metrics != nil {
+		o.metrics.modeChanged(mode, mv.writers)
+	}
 
 	// now close anything not reused from the previous mode.
 	// except stderr and stdout since you probably don't want to
@@ -465,11 +599,20 @@ func (o *Config) writersForMode(mode int) map[int]bool {
 	return rv
 }
 
-// put Nop Log func in all level that are NOT in the given mode
-func swapNop(s Mode) {
+// swapFunc returns l's Swap, or log2.Swap if l is nil
+func swapFunc(l *Logger) func(log2.Level, log2.LogFunc) {
+	if l == nil {
+		return func(l log2.Level, f log2.LogFunc) { log2.Swap(l, f) }
+	}
+	return l.Swap
+}
+
+// put Nop Log func in all level that are NOT in the given mode, with
+// swap (log2.Swap or a Logger's)
+func swapNop(swap func(log2.Level, log2.LogFunc), s Mode) {
 	for i := log2.Level(0); i < log2.HIGHEST; i++ {
 		if s[log2.Level(i)] == nil {
-			log2.Swap(i, nil)
+			swap(i, nil)
 		}
 	}
 }
@@ -479,11 +622,74 @@ func swapNop(s Mode) {
 // into a log2 logfunc. The given modeVals is expect to contain the
 // filterers, serailizers, and writers referenced by the Fsw
 // slice. Use modeValsForMode() to create a suitable modeVals value.
-func makeLogFunc(mv *modeVals, c []Fsw) log2.LogFunc {
+// LevelFilterers, LevelSerializers and LevelWriters are bound to the
+// level.
+// If levelKey is not empty the level keyval is prepended to each
+// record. If m is not nil records and writes are counted in it for
+// the given level and mode.
+func makeLogFunc(mv *modeVals, c []Fsw, level log2.Level, levelKey string, m *Metrics, mode int) log2.LogFunc {
 	mv2 := mv.copy() // func created below binds the copies
 	c2 := make([]Fsw, len(c))
 	copy(c2, c)
+	for i := range c2 {
+		fi := c2[i].FilterInd
+		if f, ok := mv2.filters[fi].(LevelFilterer); ok {
+			mv2.filters[fi] = levelFilterer{f, level}
+		}
+		si := c2[i].SerializerInd
+		if s, ok := mv2.serializers[si].(LevelSerializer); ok {
+			mv2.serializers[si] = levelSerializer{s, level}
+		}
+		wi := c2[i].WriterInd
+		if w, ok := mv2.writers[wi].(LevelWriter); ok {
+			mv2.writers[wi] = levelWriter{w, level}
+		}
+	}
+	var ls *levelStats
+	if m != nil {
+		// the copies are per level so can be metered per level
+		ls = m.levelStats(level)
+		metered := make(map[int]bool)
+		for i := range c2 {
+			wi := c2[i].WriterInd
+			if !metered[wi] {
+				metered[wi] = true
+				s := m.stats(writerKey{writer: wi, level: level, mode: mode})
+				w := mv2.writers[wi]
+				mv2.writers[wi] = keepMethods(meteredWriter{w, s}, w)
+			}
+			fi := c2[i].FilterInd
+			if _, ok := mv2.filters[fi].(meteredFilterer); !ok {
+				mv2.filters[fi] = meteredFilterer{mv2.filters[fi], ls}
+			}
+			si := c2[i].SerializerInd
+			if _, ok := mv2.serializers[si].(meteredSerializer); !ok {
+				mv2.serializers[si] = meteredSerializer{mv2.serializers[si], ls}
+			}
+		}
+	}
+	lf := makeFswFunc(mv2, c2)
+	if levelKey != "" {
+		name := LevelName(level)
+		fsw := lf
+		lf = func(keyvals ...interface{}) error {
+			kv := make([]interface{}, 0, len(keyvals)+2)
+			kv = append(append(kv, levelKey, name), keyvals...)
+			return fsw(kv...)
+		}
+	}
+	if ls == nil {
+		return lf
+	}
+	return func(keyvals ...interface{}) error {
+		atomic.AddUint64(&ls.logged, 1)
+		return lf(keyvals...)
+	}
+}
 
+// makeFswFunc returns the log func for makeLogFunc, without the
+// level keyval.
+func makeFswFunc(mv2 *modeVals, c2 []Fsw) log2.LogFunc {
 	filts := make(map[int]bool)
 	for i := range c2 {
 		filts[c2[i].FilterInd] = true
@@ -504,6 +710,7 @@ func makeLogFunc(mv *modeVals, c []Fsw) log2.LogFunc {
 			if len(kv) == 0 {
 				return nil // filtered out everything
 			}
+			kv = resolveLazy(kv)
 			for i := range c2 {
 				w := mv2.writers[c2[i].WriterInd]
 				err = mv2.serializers[c2[i].SerializerInd].Serialize(w, kv)
@@ -526,6 +733,7 @@ func makeLogFunc(mv *modeVals, c []Fsw) log2.LogFunc {
 			if len(kv) == 0 {
 				return nil // filtered out everything
 			}
+			kv = resolveLazy(kv)
 			w := mv2.writers[c2[i].WriterInd]
 			err = mv2.serializers[c2[i].SerializerInd].Serialize(w, kv)
 			if err != nil {
@@ -536,6 +744,39 @@ func makeLogFunc(mv *modeVals, c []Fsw) log2.LogFunc {
 	}
 }
 
+// levelFilterer calls FilterLevel with the level of the log func it
+// is bound to
+type levelFilterer struct {
+	f     LevelFilterer
+	level log2.Level
+}
+
+func (o levelFilterer) Filter(keyvals []interface{}) ([]interface{}, error) {
+	return o.f.FilterLevel(o.level, keyvals)
+}
+
+// levelSerializer calls SerializeLevel with the level of the log func
+// it is bound to
+type levelSerializer struct {
+	s     LevelSerializer
+	level log2.Level
+}
+
+func (o levelSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	return o.s.SerializeLevel(o.level, w, keyvals)
+}
+
+// levelWriter calls WriteLevel with the level of the log func it is
+// bound to
+type levelWriter struct {
+	w     LevelWriter
+	level log2.Level
+}
+
+func (o levelWriter) Write(p []byte) (int, error) {
+	return o.w.WriteLevel(o.level, p)
+}
+
 // modeVals holds the objects created from the factories for the current mode
 type modeVals struct {
 	filters     []Filterer   // sparse, always len(Config.filterFacs), may have nil entries
@@ -1,9 +1,12 @@
 package logfu_test
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/msample/log2"
@@ -237,3 +240,370 @@ func TestNew(t *testing.T) {
 		t.Error("expected config failure 6")
 	}
 }
+
+func TestLazyValues(t *testing.T) {
+	var buf bytes.Buffer
+	calls := 0
+	dropDebug := func() (logfu.Filterer, error) {
+		return logfu.FilterFunc(func(kv []interface{}) ([]interface{}, error) {
+			if kv[1] == "drop me" {
+				return nil, nil
+			}
+			return kv, nil
+		}), nil
+	}
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{dropDebug},
+		[]logfu.SerializerFac{serializer1Fac},
+		[]logfu.WriterFac{func() (io.Writer, error) { return &buf, nil }},
+		[]logfu.Mode{{log2.INFO: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	lazy := logfu.Lazy(func() interface{} {
+		calls++
+		return "expensive"
+	})
+
+	log2.Debug("msg", "nop level", "v", lazy)
+	log2.Info("msg", "drop me", "v", lazy)
+	if calls != 0 {
+		t.Errorf("lazy value resolved for dropped records: %v calls", calls)
+	}
+	log2.Info("msg", "keep me", "v", lazy)
+	if calls != 1 {
+		t.Errorf("expected lazy value resolved once, got %v", calls)
+	}
+	if got := buf.String(); got != "[msg keep me v expensive]\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+	log2.Swap(log2.INFO, nil)
+}
+
+func TestSetLevelKey(t *testing.T) {
+	var buf bytes.Buffer
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{serializer1Fac},
+		[]logfu.WriterFac{func() (io.Writer, error) { return &buf, nil }},
+		[]logfu.Mode{{log2.WARN: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.SetLevelKey(logfu.LevelKey)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	log2.Warn("msg", "careful")
+	if got := buf.String(); got != "[level warn msg careful]\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+	log2.Swap(log2.WARN, nil)
+}
+
+func TestDumpWriters(t *testing.T) {
+	var dump bytes.Buffer
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{serializer1Fac},
+		[]logfu.WriterFac{logfu.RingWriterFac(logfu.RingOpts{
+			DumpTo: func() (io.Writer, error) { return &dump, nil },
+		})},
+		[]logfu.Mode{{log2.DEBUG: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	log2.Debug("msg", "held")
+	if dump.Len() != 0 {
+		t.Fatalf("unexpected output before dump: %q", dump.String())
+	}
+	if err := lf.DumpWriters(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dump.String(); got != "[msg held]\n" {
+		t.Errorf("unexpected dump: %q", got)
+	}
+	log2.Swap(log2.DEBUG, nil)
+}
+
+func TestRingWriterTriggerLevel(t *testing.T) {
+	var dump bytes.Buffer
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{serializer1Fac},
+		[]logfu.WriterFac{logfu.RingWriterFac(logfu.RingOpts{
+			DumpTo:        func() (io.Writer, error) { return &dump, nil },
+			TriggerLevels: []log2.Level{log2.ERROR},
+		})},
+		[]logfu.Mode{{
+			log2.ERROR: []logfu.Fsw{{0, 0, 0}},
+			log2.DEBUG: []logfu.Fsw{{0, 0, 0}},
+		}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Swap(log2.ERROR, nil)
+	defer log2.Swap(log2.DEBUG, nil)
+	log2.Debug("msg", "error")
+	if dump.Len() != 0 {
+		t.Fatalf("unexpected dump for DEBUG: %q", dump.String())
+	}
+	log2.Error("msg", "boom")
+	if got := dump.String(); got != "[msg error]\n[msg boom]\n" {
+		t.Errorf("unexpected dump: %q", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	fail := errors.New("sink down")
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{serializer1Fac},
+		[]logfu.WriterFac{
+			func() (io.Writer, error) { return &buf, nil },
+			func() (io.Writer, error) { return errWriter{fail}, nil },
+		},
+		[]logfu.Mode{{
+			log2.ERROR: []logfu.Fsw{{0, 0, 0}, {0, 0, 1}},
+			log2.INFO:  []logfu.Fsw{{0, 0, 0}},
+		}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := logfu.NewMetrics()
+	lf.SetMetrics(m)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	log2.Info("msg", "one")
+	log2.Info("msg", "two")
+	if err := log2.Error("msg", "three"); err != fail {
+		t.Errorf("expected write error, got %v", err)
+	}
+
+	s := m.Snapshot()
+	if len(s.Writers) != 3 {
+		t.Fatalf("expected 3 writer/level/mode entries, got %+v", s.Writers)
+	}
+	w0 := s.ByWriter()[0]
+	if w0.Records != 3 || w0.Bytes != uint64(buf.Len()) || w0.Errors != 0 {
+		t.Errorf("unexpected writer 0 stats %+v", w0)
+	}
+	var n uint64
+	for _, c := range w0.Latency {
+		n += c
+	}
+	if n != 3 {
+		t.Errorf("expected 3 latency observations, got %v", n)
+	}
+	w1 := s.Writers[2]
+	if w1.Writer != 1 || w1.Level != "error" || w1.Records != 1 || w1.Errors != 1 || w1.LastError != "sink down" {
+		t.Errorf("unexpected writer 1 stats %+v", w1)
+	}
+	if s.Mode != 0 || s.ModeChanges != 1 {
+		t.Errorf("unexpected mode %v, changes %v", s.Mode, s.ModeChanges)
+	}
+	want := []logfu.LevelStats{{Level: "error", Logged: 1}, {Level: "info", Logged: 2}}
+	if !reflect.DeepEqual(s.Levels, want) {
+		t.Errorf("expected level stats %+v, got %+v", want, s.Levels)
+	}
+	log2.Swap(log2.ERROR, nil)
+	log2.Swap(log2.INFO, nil)
+}
+
+func TestMetricsWrappedWriters(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	var sawFd bool
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{func() (logfu.Serializer, error) { return fdSerializer{&sawFd}, nil }},
+		[]logfu.WriterFac{
+			func() (io.Writer, error) { return &fdWriter{f: null}, nil },
+			logfu.LimitWriterFac(func() (io.Writer, error) { return &dropWriter{5}, nil }, 100),
+		},
+		[]logfu.Mode{{log2.INFO: []logfu.Fsw{{0, 0, 0}, {0, 0, 1}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := logfu.NewMetrics()
+	lf.SetMetrics(m)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Swap(log2.INFO, nil)
+	log2.Info("msg", "one")
+	if !sawFd {
+		t.Error("expected the metered writer to keep Fd")
+	}
+	if d := m.Snapshot().Dropped; d[1] != 5 {
+		t.Errorf("expected 5 dropped inside the LimitWriter, got %v", d)
+	}
+}
+
+// fdSerializer notes whether it's given a writer with Fd
+type fdSerializer struct {
+	sawFd *bool
+}
+
+func (o fdSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	if _, ok := w.(interface{ Fd() uintptr }); ok {
+		*o.sawFd = true
+	}
+	_, err := w.Write([]byte("x\n"))
+	return err
+}
+
+type dropWriter struct {
+	dropped uint64
+}
+
+func (o *dropWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func (o *dropWriter) Dropped() uint64 { return o.dropped }
+
+func TestSetLoggerSwitch(t *testing.T) {
+	var ws []*closeWriter
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{logfu.LogfmtSerializerFac},
+		[]logfu.WriterFac{func() (io.Writer, error) {
+			w := &closeWriter{}
+			ws = append(ws, w)
+			return w, nil
+		}},
+		[]logfu.Mode{{log2.ERROR: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1, l2 := logfu.NewLogger(), logfu.NewLogger()
+	lf.SetLogger(l1)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	lf.SetLogger(l2)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(ws) != 2 || !ws[0].closed {
+		t.Fatalf("expected the first writer to be replaced and closed")
+	}
+	if err := l1.Error("msg", "old"); err != nil {
+		t.Errorf("old Logger still logs to its closed writer: %v", err)
+	}
+	if err := l2.Error("msg", "new"); err != nil || ws[1].n != 1 {
+		t.Errorf("expected new Logger to log, got %v", err)
+	}
+}
+
+// closeWriter fails writes once closed
+type closeWriter struct {
+	n      int
+	closed bool
+}
+
+func (o *closeWriter) Write(p []byte) (int, error) {
+	if o.closed {
+		return 0, errors.New("write after close")
+	}
+	o.n++
+	return len(p), nil
+}
+
+func (o *closeWriter) Close() error {
+	o.closed = true
+	return nil
+}
+
+type errWriter struct {
+	err error
+}
+
+func (o errWriter) Write(p []byte) (int, error) {
+	return 0, o.err
+}
+
+func TestLogger(t *testing.T) {
+	newLogger := func(buf *bytes.Buffer) (*logfu.Config, *logfu.Logger) {
+		lf, err := logfu.New(
+			[]logfu.FiltererFac{logfu.IdentityFilterFac},
+			[]logfu.SerializerFac{logfu.LogfmtSerializerFac},
+			[]logfu.WriterFac{func() (io.Writer, error) { return buf, nil }},
+			[]logfu.Mode{
+				{log2.ERROR: []logfu.Fsw{{0, 0, 0}}},
+				{log2.ERROR: []logfu.Fsw{{0, 0, 0}}, log2.DEBUG: []logfu.Fsw{{0, 0, 0}}},
+			},
+			false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := logfu.NewLogger()
+		lf.SetLogger(l)
+		if err = lf.ChangeToMode(0, true, true); err != nil {
+			t.Fatal(err)
+		}
+		return lf, l
+	}
+
+	// each pipeline only sees its own records, and log2 none
+	var global bytes.Buffer
+	gl, _ := newLogger(&global)
+	gl.SetLogger(nil)
+	gl.ChangeToMode(0, true, true)
+	defer log2.Swap(log2.ERROR, nil)
+	t.Run("group", func(t *testing.T) {
+		for _, name := range []string{"a", "b"} {
+			name := name
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				var buf bytes.Buffer
+				lf, l := newLogger(&buf)
+				l.Error("sub", name)
+				l.Debug("sub", name)
+				lf.NextMode()
+				l.Debug("sub", name)
+				l.Info("sub", name)
+				if want := "sub=" + name + "\nsub=" + name + "\n"; buf.String() != want {
+					t.Errorf("expected %q, got %q", want, buf.String())
+				}
+			})
+		}
+	})
+	if global.Len() != 0 {
+		t.Errorf("unexpected global output %q", global.String())
+	}
+
+	// the global funcs can delegate to a Logger
+	var buf bytes.Buffer
+	_, l := newLogger(&buf)
+	l.Delegate()
+	defer log2.Swap(log2.WARN, nil)
+	defer log2.Swap(log2.INFO, nil)
+	defer log2.Swap(log2.DEBUG, nil)
+	defer log2.Swap(log2.AUDIT, nil)
+	log2.Error("msg", "via log2")
+	log2.Info("msg", "nop")
+	if buf.String() != "msg=\"via log2\"\n" || global.Len() != 0 {
+		t.Errorf("unexpected output %q, global %q", buf.String(), global.String())
+	}
+}
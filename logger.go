@@ -0,0 +1,83 @@
+package logfu
+
+import (
+	"sync/atomic"
+
+	"github.com/msample/log2"
+)
+
+// Logger has the log2 level funcs as methods, so a Config's pipeline
+// can run apart from the global log2 funcs, e.g. one per subsystem
+// or per parallel test. Use Config.SetLogger to have a Config swap
+// its log funcs into a Logger instead of log2, and Delegate to have
+// the log2 funcs log to it too.
+//
+// Levels log nothing until a Config swaps them in, as does the zero
+// Logger. Safe for concurrent use.
+type Logger struct {
+	funcs [log2.HIGHEST]atomic.Value // log2.LogFunc
+}
+
+// NewLogger returns a Logger with every level a no-op
+func NewLogger() *Logger {
+	return &Logger{}
+}
+
+func nopLog(keyvals ...interface{}) error {
+	return nil
+}
+
+// Swap sets the log func for level l, like log2.Swap. A nil f makes
+// the level a no-op.
+func (o *Logger) Swap(l log2.Level, f log2.LogFunc) {
+	if l < 0 || l >= log2.HIGHEST {
+		return
+	}
+	if f == nil {
+		f = nopLog
+	}
+	o.funcs[l].Store(f)
+}
+
+// Log logs keyvals at level l
+func (o *Logger) Log(l log2.Level, keyvals ...interface{}) error {
+	if l < 0 || l >= log2.HIGHEST {
+		return nil
+	}
+	f, _ := o.funcs[l].Load().(log2.LogFunc)
+	if f == nil {
+		return nil
+	}
+	return f(keyvals...)
+}
+
+func (o *Logger) Error(keyvals ...interface{}) error {
+	return o.Log(log2.ERROR, keyvals...)
+}
+
+func (o *Logger) Warn(keyvals ...interface{}) error {
+	return o.Log(log2.WARN, keyvals...)
+}
+
+func (o *Logger) Info(keyvals ...interface{}) error {
+	return o.Log(log2.INFO, keyvals...)
+}
+
+func (o *Logger) Debug(keyvals ...interface{}) error {
+	return o.Log(log2.DEBUG, keyvals...)
+}
+
+func (o *Logger) Audit(keyvals ...interface{}) error {
+	return o.Log(log2.AUDIT, keyvals...)
+}
+
+// Delegate makes the global log2 funcs log to o, following its mode
+// changes. Swap nil funcs into log2 to stop.
+func (o *Logger) Delegate() {
+	for i := log2.Level(0); i < log2.HIGHEST; i++ {
+		l := i
+		log2.Swap(l, func(keyvals ...interface{}) error {
+			return o.Log(l, keyvals...)
+		})
+	}
+}
@@ -0,0 +1,427 @@
+package logfu
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MatchFilterFac returns a FiltererFac for a Filterer that keeps only
+// the records for which the given match expression is true. The
+// expression is parsed when the factory is called so a bad one fails
+// the mode change rather than logging.
+//
+// Expressions compare keyval values by key:
+//
+//	tenant == "acme"
+//	path != "/healthz" and status >= 500
+//	msg =~ "^conn(ect)? refused" or exists(err)
+//	not (level == "debug" || user !~ "^svc-")
+//
+// Operators are ==, !=, =~, !~ (regexp), <, <=, >, >= (numeric),
+// exists(key), and, or, not and their &&, || and ! forms. Values are
+// double-quoted strings, numbers, true or false. == and != compare
+// numerically when the value is a number, otherwise as strings of
+// the keyval value's fmt.Sprint form. Comparisons against a missing
+// key are false, so != and !~ are true for it.
+func MatchFilterFac(expr string) func() (Filterer, error) {
+	return func() (Filterer, error) {
+		m, err := ParseMatch(expr)
+		if err != nil {
+			return nil, err
+		}
+		return FilterFunc(func(keyvals []interface{}) ([]interface{}, error) {
+			if m.Match(keyvals) {
+				return keyvals, nil
+			}
+			return nil, nil
+		}), nil
+	}
+}
+
+// DropFilterFac is the opposite of MatchFilterFac, its Filterer drops
+// the records that match the given expression.
+func DropFilterFac(expr string) func() (Filterer, error) {
+	return func() (Filterer, error) {
+		m, err := ParseMatch(expr)
+		if err != nil {
+			return nil, err
+		}
+		return FilterFunc(func(keyvals []interface{}) ([]interface{}, error) {
+			if m.Match(keyvals) {
+				return nil, nil
+			}
+			return keyvals, nil
+		}), nil
+	}
+}
+
+// MatchExpr is a parsed match expression. See MatchFilterFac for the
+// syntax.
+type MatchExpr struct {
+	src  string
+	root matchNode
+}
+
+// ParseMatch parses a match expression. See MatchFilterFac for the
+// syntax.
+func ParseMatch(expr string) (*MatchExpr, error) {
+	toks, err := lexMatch(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &matchParser{toks: toks}
+	n, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("match expression %q: %v", expr, err)
+	}
+	if t := p.peek(); t.kind != mtEOF {
+		return nil, fmt.Errorf("match expression %q: unexpected %q at %v", expr, t.text, t.pos)
+	}
+	return &MatchExpr{src: expr, root: n}, nil
+}
+
+// Match reports whether the given keyvals satisfy the expression
+func (o *MatchExpr) Match(keyvals []interface{}) bool {
+	return o.root.eval(keyvals)
+}
+
+func (o *MatchExpr) String() string {
+	return o.src
+}
+
+type matchNode interface {
+	eval(keyvals []interface{}) bool
+}
+
+type matchAnd struct{ l, r matchNode }
+type matchOr struct{ l, r matchNode }
+type matchNot struct{ n matchNode }
+type matchExists struct{ key string }
+type matchBool bool
+
+type matchCmp struct {
+	key   string
+	op    string
+	str   string         // string form of the literal
+	num   float64        // numeric literal when isNum
+	re    *regexp.Regexp // for =~ and !~
+	isNum bool
+}
+
+func (o matchAnd) eval(kv []interface{}) bool  { return o.l.eval(kv) && o.r.eval(kv) }
+func (o matchOr) eval(kv []interface{}) bool   { return o.l.eval(kv) || o.r.eval(kv) }
+func (o matchNot) eval(kv []interface{}) bool  { return !o.n.eval(kv) }
+func (o matchBool) eval(kv []interface{}) bool { return bool(o) }
+
+func (o matchExists) eval(kv []interface{}) bool {
+	_, ok := lookup(kv, o.key)
+	return ok
+}
+
+func (o *matchCmp) eval(kv []interface{}) bool {
+	v, ok := lookup(kv, o.key)
+	switch o.op {
+	case "!=":
+		return !ok || !o.equal(v)
+	case "!~":
+		return !ok || !o.re.MatchString(fmt.Sprint(v))
+	}
+	if !ok {
+		return false
+	}
+	switch o.op {
+	case "==":
+		return o.equal(v)
+	case "=~":
+		return o.re.MatchString(fmt.Sprint(v))
+	}
+	f, ok := toFloat(v)
+	if !ok {
+		return false
+	}
+	switch o.op {
+	case "<":
+		return f < o.num
+	case "<=":
+		return f <= o.num
+	case ">":
+		return f > o.num
+	case ">=":
+		return f >= o.num
+	}
+	return false
+}
+
+func (o *matchCmp) equal(v interface{}) bool {
+	if o.isNum {
+		f, ok := toFloat(v)
+		return ok && f == o.num
+	}
+	return fmt.Sprint(v) == o.str
+}
+
+// toFloat converts numeric keyval values, and strings holding
+// numbers, to float64.
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case time.Duration:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// match expression tokens
+
+type mtKind int
+
+const (
+	mtEOF mtKind = iota
+	mtIdent
+	mtString
+	mtNumber
+	mtOp
+	mtLParen
+	mtRParen
+)
+
+type mtoken struct {
+	kind mtKind
+	text string
+	pos  int
+}
+
+var matchOps = []string{"==", "!=", "=~", "!~", "<=", ">=", "&&", "||", "<", ">", "!"}
+
+func lexMatch(s string) ([]mtoken, error) {
+	var rv []mtoken
+	i := 0
+outer:
+	for i < len(s) {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			rv = append(rv, mtoken{mtLParen, "(", i})
+			i++
+		case c == ')':
+			rv = append(rv, mtoken{mtRParen, ")", i})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("match expression %q: unterminated string at %v", s, i)
+			}
+			str, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("match expression %q: bad string at %v: %v", s, i, err)
+			}
+			rv = append(rv, mtoken{mtString, str, i})
+			i = j + 1
+		case c == '-' || c == '+' || c == '.' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && strings.IndexByte("0123456789.eE+-_xXabcdefABCDEF", s[j]) >= 0 {
+				j++
+			}
+			rv = append(rv, mtoken{mtNumber, s[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || s[j] == '-' ||
+				unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			rv = append(rv, mtoken{mtIdent, s[i:j], i})
+			i = j
+		default:
+			for _, op := range matchOps {
+				if strings.HasPrefix(s[i:], op) {
+					rv = append(rv, mtoken{mtOp, op, i})
+					i += len(op)
+					continue outer
+				}
+			}
+			return nil, fmt.Errorf("match expression %q: unexpected %q at %v", s, c, i)
+		}
+	}
+	return append(rv, mtoken{mtEOF, "", len(s)}), nil
+}
+
+// recursive descent parser for match expressions
+type matchParser struct {
+	toks []mtoken
+	i    int
+}
+
+func (o *matchParser) peek() mtoken {
+	return o.toks[o.i]
+}
+
+func (o *matchParser) next() mtoken {
+	t := o.toks[o.i]
+	if t.kind != mtEOF {
+		o.i++
+	}
+	return t
+}
+
+// isWord reports if t is the given keyword or operator
+func isWord(t mtoken, words ...string) bool {
+	if t.kind != mtIdent && t.kind != mtOp {
+		return false
+	}
+	for _, w := range words {
+		if t.text == w {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *matchParser) or() (matchNode, error) {
+	l, err := o.and()
+	if err != nil {
+		return nil, err
+	}
+	for isWord(o.peek(), "or", "||") {
+		o.next()
+		r, err := o.and()
+		if err != nil {
+			return nil, err
+		}
+		l = matchOr{l, r}
+	}
+	return l, nil
+}
+
+func (o *matchParser) and() (matchNode, error) {
+	l, err := o.unary()
+	if err != nil {
+		return nil, err
+	}
+	for isWord(o.peek(), "and", "&&") {
+		o.next()
+		r, err := o.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = matchAnd{l, r}
+	}
+	return l, nil
+}
+
+func (o *matchParser) unary() (matchNode, error) {
+	if isWord(o.peek(), "not", "!") {
+		o.next()
+		n, err := o.unary()
+		if err != nil {
+			return nil, err
+		}
+		return matchNot{n}, nil
+	}
+	return o.primary()
+}
+
+func (o *matchParser) primary() (matchNode, error) {
+	t := o.next()
+	switch {
+	case t.kind == mtLParen:
+		n, err := o.or()
+		if err != nil {
+			return nil, err
+		}
+		if c := o.next(); c.kind != mtRParen {
+			return nil, fmt.Errorf("expected ) at %v", c.pos)
+		}
+		return n, nil
+	case isWord(t, "true"):
+		return matchBool(true), nil
+	case isWord(t, "false"):
+		return matchBool(false), nil
+	case isWord(t, "exists") && o.peek().kind == mtLParen:
+		o.next()
+		k := o.next()
+		if k.kind != mtIdent && k.kind != mtString {
+			return nil, fmt.Errorf("expected key in exists() at %v", k.pos)
+		}
+		if c := o.next(); c.kind != mtRParen {
+			return nil, fmt.Errorf("expected ) at %v", c.pos)
+		}
+		return matchExists{k.text}, nil
+	case t.kind == mtIdent || t.kind == mtString:
+		return o.comparison(t.text)
+	case t.kind == mtEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %v", t.text, t.pos)
+}
+
+func (o *matchParser) comparison(key string) (matchNode, error) {
+	op := o.next()
+	if op.kind != mtOp || !isWord(op, "==", "!=", "=~", "!~", "<", "<=", ">", ">=") {
+		return nil, fmt.Errorf("expected comparison operator after %q at %v", key, op.pos)
+	}
+	v := o.next()
+	rv := &matchCmp{key: key, op: op.text, str: v.text}
+	switch {
+	case v.kind == mtString:
+	case v.kind == mtNumber:
+		f, err := strconv.ParseFloat(v.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %v", v.text, v.pos)
+		}
+		rv.num, rv.isNum = f, true
+	case isWord(v, "true", "false"):
+	default:
+		return nil, fmt.Errorf("expected value after %q at %v", op.text, v.pos)
+	}
+	switch op.text {
+	case "=~", "!~":
+		re, err := regexp.Compile(rv.str)
+		if err != nil {
+			return nil, fmt.Errorf("bad regexp at %v: %v", v.pos, err)
+		}
+		rv.re = re
+	case "<", "<=", ">", ">=":
+		if !rv.isNum {
+			return nil, fmt.Errorf("%q needs a number at %v", op.text, v.pos)
+		}
+	}
+	return rv, nil
+}
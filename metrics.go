@@ -0,0 +1,425 @@
+package logfu
+
+import (
+	"expvar"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/msample/log2"
+)
+
+// LatencyBuckets are the upper bounds of the write latency histogram
+// buckets kept by Metrics. Slower writes are counted in a last,
+// unbounded bucket.
+var LatencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Metrics collects write counts, bytes, errors and latencies for a
+// Config's writers, per writer index, level and mode, along with
+// per level record counts, the current mode and the records dropped
+// by Dropper writers. Use Config.SetMetrics to collect them and
+// Snapshot to read them. A Metrics may be shared by Configs, but
+// their writer indexes and levels will be counted together and the
+// mode and dropped counts are only right for one of them.
+type Metrics struct {
+	mutex       sync.Mutex
+	writers     map[writerKey]*writerStats
+	levels      map[log2.Level]*levelStats
+	mode        int
+	modeChanges uint64
+	droppers    map[Dropper]int // current mode's, to writer index
+	droppedBase map[int]uint64  // dropped by replaced writers
+}
+
+// Dropper is implemented by asynchronous writers, like HTTPWriter,
+// that drop records after Write has returned. Dropped returns the
+// number dropped so far. Metrics tracks Droppers by identity, so
+// implement it on a pointer type. Droppers inside this package's
+// FailoverWriter, FanoutWriter, MultiWriterCloser, LimitWriter and
+// RSWriter are counted against the outer writer's index, but one
+// made by a FailoverWriter or FanoutWriter probe to replace a failed
+// writer isn't counted until the next mode change.
+type Dropper interface {
+	Dropped() uint64
+}
+
+type writerKey struct {
+	writer int
+	level  log2.Level
+	mode   int
+}
+
+type writerStats struct {
+	records    uint64 // 64 bit atomics first for 32 bit platforms
+	bytes      uint64
+	errors     uint64
+	latencySum int64    // ns
+	latency    []uint64 // len(LatencyBuckets)+1
+	errMutex   sync.Mutex
+	lastErr    string
+	lastErrAt  time.Time
+}
+
+type levelStats struct {
+	logged    uint64
+	filtered  uint64
+	serErrors uint64
+}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		writers:     make(map[writerKey]*writerStats),
+		levels:      make(map[log2.Level]*levelStats),
+		droppedBase: make(map[int]uint64),
+	}
+}
+
+// stats returns the stats for k, creating them if needed
+func (o *Metrics) stats(k writerKey) *writerStats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	s := o.writers[k]
+	if s == nil {
+		s = &writerStats{latency: make([]uint64, len(LatencyBuckets)+1)}
+		o.writers[k] = s
+	}
+	return s
+}
+
+// levelStats returns the stats for level l, creating them if needed
+func (o *Metrics) levelStats(l log2.Level) *levelStats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	s := o.levels[l]
+	if s == nil {
+		s = &levelStats{}
+		o.levels[l] = s
+	}
+	return s
+}
+
+// modeChanged records a change to mode, with writers, from the
+// modeVals, replacing the previous mode's Droppers. The counts of
+// those no longer used are kept so dropped counts never go down.
+func (o *Metrics) modeChanged(mode int, writers []io.Writer) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.mode = mode
+	o.modeChanges++
+	cur := make(map[Dropper]int)
+	for i, w := range writers {
+		findDroppers(w, i, cur)
+	}
+	for d, i := range o.droppers {
+		if _, ok := cur[d]; !ok {
+			o.droppedBase[i] += d.Dropped()
+		}
+	}
+	o.droppers = cur
+}
+
+// findDroppers adds w to droppers, with index i, if it is a Dropper,
+// or else the Droppers it wraps
+func findDroppers(w io.Writer, i int, droppers map[Dropper]int) {
+	if d, ok := w.(Dropper); ok {
+		droppers[d] = i
+		return
+	}
+	if n, ok := w.(nestingWriter); ok {
+		for _, w2 := range n.nested() {
+			findDroppers(w2, i, droppers)
+		}
+	}
+}
+
+// nestingWriter is implemented by writers that wrap others, so
+// Metrics can find the Droppers among them
+type nestingWriter interface {
+	nested() []io.Writer
+}
+
+// meteredFilterer counts the records its Filterer removes
+type meteredFilterer struct {
+	f Filterer
+	s *levelStats
+}
+
+func (o meteredFilterer) Filter(keyvals []interface{}) ([]interface{}, error) {
+	kv, err := o.f.Filter(keyvals)
+	if err == nil && len(kv) == 0 {
+		atomic.AddUint64(&o.s.filtered, 1)
+	}
+	return kv, err
+}
+
+// meteredSerializer counts the errors from its Serializer that
+// aren't write errors, which meteredWriter counts
+type meteredSerializer struct {
+	s  Serializer
+	ls *levelStats
+}
+
+func (o meteredSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	tw := &trackingWriter{w: w}
+	err := o.s.Serialize(keepMethods(tw, w), keyvals)
+	if err != nil && !tw.failed {
+		atomic.AddUint64(&o.ls.serErrors, 1)
+	}
+	return err
+}
+
+// trackingWriter notes whether a Write failed
+type trackingWriter struct {
+	w      io.Writer
+	failed bool
+}
+
+func (o *trackingWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	if err != nil {
+		o.failed = true
+	}
+	return n, err
+}
+
+// keepMethods returns w, which wraps src, with the methods of src
+// that writers are checked for: Fd, used by the console serializer to
+// detect terminals, and the Flush and Dropped methods of an
+// HTTPWriter
+func keepMethods(w, src io.Writer) io.Writer {
+	switch x := src.(type) {
+	case fdWriter:
+		return withFd{w, x}
+	case flushDropper:
+		return withFlushDropper{withFlush{w, x}, x}
+	case flusher:
+		return withFlush{w, x}
+	}
+	return w
+}
+
+type fdWriter interface {
+	io.Writer
+	Fd() uintptr
+}
+
+type flusher interface {
+	io.Writer
+	Flush() error
+}
+
+type flushDropper interface {
+	flusher
+	Dropper
+}
+
+type withFd struct {
+	io.Writer
+	src fdWriter
+}
+
+func (o withFd) Fd() uintptr {
+	return o.src.Fd()
+}
+
+type withFlush struct {
+	io.Writer
+	src flusher
+}
+
+func (o withFlush) Flush() error {
+	return o.src.Flush()
+}
+
+type withFlushDropper struct {
+	withFlush
+	d Dropper
+}
+
+func (o withFlushDropper) Dropped() uint64 {
+	return o.d.Dropped()
+}
+
+// meteredWriter counts each Write, a record per the Serializer
+// contract, in s
+type meteredWriter struct {
+	w io.Writer
+	s *writerStats
+}
+
+func (o meteredWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := o.w.Write(p)
+	d := time.Since(start)
+
+	s := o.s
+	atomic.AddUint64(&s.records, 1)
+	atomic.AddUint64(&s.bytes, uint64(n))
+	atomic.AddInt64(&s.latencySum, int64(d))
+	b := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	atomic.AddUint64(&s.latency[b], 1)
+	if err != nil {
+		atomic.AddUint64(&s.errors, 1)
+		s.errMutex.Lock()
+		s.lastErr, s.lastErrAt = err.Error(), time.Now()
+		s.errMutex.Unlock()
+	}
+	return n, err
+}
+
+// WriterStats are the write metrics for one writer index, level and
+// mode.
+type WriterStats struct {
+	Writer int
+	Level  string
+	Mode   int
+
+	Records uint64 // writes, including failed ones
+	Bytes   uint64
+	Errors  uint64
+
+	LastError     string    `json:",omitempty"`
+	LastErrorTime time.Time `json:",omitempty"`
+
+	// Latency counts writes per LatencyBuckets bucket, with the
+	// last entry counting slower ones.
+	Latency    []uint64
+	LatencySum time.Duration
+}
+
+func (o *WriterStats) add(s WriterStats) {
+	o.Records += s.Records
+	o.Bytes += s.Bytes
+	o.Errors += s.Errors
+	if s.LastErrorTime.After(o.LastErrorTime) {
+		o.LastError, o.LastErrorTime = s.LastError, s.LastErrorTime
+	}
+	if o.Latency == nil {
+		o.Latency = make([]uint64, len(s.Latency))
+	}
+	for i, n := range s.Latency {
+		o.Latency[i] += n
+	}
+	o.LatencySum += s.LatencySum
+}
+
+// LevelStats are the record counts for one level.
+type LevelStats struct {
+	Level string
+
+	Logged          uint64 // log calls, including filtered ones
+	Filtered        uint64 // filter calls that removed the record
+	SerializeErrors uint64 // Serialize errors other than write errors
+}
+
+// MetricsSnapshot is a copy of a Metrics' values at a point in time.
+type MetricsSnapshot struct {
+	Time        time.Time
+	Mode        int // the current mode
+	ModeChanges uint64
+	Levels      []LevelStats  // by Level
+	Writers     []WriterStats // by Writer, Mode, then Level
+
+	// Dropped counts the records dropped by Dropper writers, by
+	// writer index.
+	Dropped map[int]uint64 `json:",omitempty"`
+}
+
+// Snapshot returns the current values
+func (o *Metrics) Snapshot() MetricsSnapshot {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	rv := MetricsSnapshot{
+		Time:        time.Now(),
+		Mode:        o.mode,
+		ModeChanges: o.modeChanges,
+		Levels:      make([]LevelStats, 0, len(o.levels)),
+		Writers:     make([]WriterStats, 0, len(o.writers)),
+	}
+	for l, s := range o.levels {
+		rv.Levels = append(rv.Levels, LevelStats{
+			Level:           LevelName(l),
+			Logged:          atomic.LoadUint64(&s.logged),
+			Filtered:        atomic.LoadUint64(&s.filtered),
+			SerializeErrors: atomic.LoadUint64(&s.serErrors),
+		})
+	}
+	sort.Slice(rv.Levels, func(i, j int) bool { return rv.Levels[i].Level < rv.Levels[j].Level })
+	if len(o.droppers) > 0 || len(o.droppedBase) > 0 {
+		rv.Dropped = make(map[int]uint64)
+		for i, n := range o.droppedBase {
+			rv.Dropped[i] = n
+		}
+		for d, i := range o.droppers {
+			rv.Dropped[i] += d.Dropped()
+		}
+	}
+	for k, s := range o.writers {
+		ws := WriterStats{
+			Writer:     k.writer,
+			Level:      LevelName(k.level),
+			Mode:       k.mode,
+			Records:    atomic.LoadUint64(&s.records),
+			Bytes:      atomic.LoadUint64(&s.bytes),
+			Errors:     atomic.LoadUint64(&s.errors),
+			Latency:    make([]uint64, len(s.latency)),
+			LatencySum: time.Duration(atomic.LoadInt64(&s.latencySum)),
+		}
+		for i := range s.latency {
+			ws.Latency[i] = atomic.LoadUint64(&s.latency[i])
+		}
+		s.errMutex.Lock()
+		ws.LastError, ws.LastErrorTime = s.lastErr, s.lastErrAt
+		s.errMutex.Unlock()
+		rv.Writers = append(rv.Writers, ws)
+	}
+	sort.Slice(rv.Writers, func(i, j int) bool {
+		a, b := rv.Writers[i], rv.Writers[j]
+		if a.Writer != b.Writer {
+			return a.Writer < b.Writer
+		}
+		if a.Mode != b.Mode {
+			return a.Mode < b.Mode
+		}
+		return a.Level < b.Level
+	})
+	return rv
+}
+
+// ByWriter returns the stats summed over levels and modes for each
+// writer index, e.g. to alert on a failing sink. Level is empty and
+// Mode zero.
+func (o MetricsSnapshot) ByWriter() map[int]WriterStats {
+	rv := make(map[int]WriterStats)
+	for _, s := range o.Writers {
+		t := rv[s.Writer]
+		t.Writer = s.Writer
+		t.add(s)
+		rv[s.Writer] = t
+	}
+	return rv
+}
+
+// Publish publishes the snapshot as an expvar.Var with the given
+// name, shown by the /debug/vars handler. Like expvar.Publish it
+// panics if the name is already used.
+func (o *Metrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return o.Snapshot() }))
+}
@@ -0,0 +1,500 @@
+package logfu
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// otlpSeverities maps level names to OpenTelemetry severity numbers
+// and text
+var otlpSeverities = map[string]struct {
+	num  int
+	text string
+}{
+	"debug": {5, "DEBUG"},
+	"info":  {9, "INFO"},
+	"audit": {11, "AUDIT"},
+	"warn":  {13, "WARN"},
+	"error": {17, "ERROR"},
+}
+
+// OTLPOpts configures the Serializer returned by OTLPSerializerFac.
+type OTLPOpts struct {
+	// MsgKey's value is the record body. Defaults to "msg".
+	MsgKey string
+
+	// LevelKey's value sets the severity. Defaults to LevelKey.
+	LevelKey string
+
+	// TimeKey's time.Time value is the record time. Defaults to
+	// "ts".
+	TimeKey string
+
+	// TraceIDKey and SpanIDKey values, as hex strings or byte
+	// slices or arrays, are the trace context. They default to
+	// "trace_id" and "span_id". Values of the wrong length are
+	// written as attributes.
+	TraceIDKey string
+	SpanIDKey  string
+
+	// Resource attributes, e.g. {"service.name": "billing"}.
+	Resource map[string]interface{}
+
+	// Scope is the instrumentation scope name. Defaults to
+	// "github.com/msample/logfu".
+	Scope string
+}
+
+// OTLPSerializerFac returns a SerializerFac for OpenTelemetry
+// OTLP/JSON. Each record is written as an ExportLogsServiceRequest
+// holding one LogRecord, on one line, which is the OTLP JSON file
+// format and can be posted to a collector as is. OTLPHTTPWriter
+// merges them into batches.
+//
+// Remaining keyvals become attributes, with nested maps and slices
+// written as kvlist and array values.
+func OTLPSerializerFac(opts OTLPOpts) func() (Serializer, error) {
+	if opts.MsgKey == "" {
+		opts.MsgKey = "msg"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	if opts.TimeKey == "" {
+		opts.TimeKey = "ts"
+	}
+	if opts.TraceIDKey == "" {
+		opts.TraceIDKey = "trace_id"
+	}
+	if opts.SpanIDKey == "" {
+		opts.SpanIDKey = "span_id"
+	}
+	if opts.Scope == "" {
+		opts.Scope = "github.com/msample/logfu"
+	}
+
+	// the envelope is the same for every record
+	head := []byte(`{"resourceLogs":[{"resource":{"attributes":`)
+	head = appendOTLPKVList(head, opts.Resource, 0)
+	head = append(head, `},"scopeLogs":[{"scope":{"name":`...)
+	head = appendJSONString(head, opts.Scope)
+	head = append(head, `},"logRecords":[`...)
+	return func() (Serializer, error) {
+		return SerializerFunc(func(w io.Writer, keyvals []interface{}) error {
+			bp := getBuf()
+			defer putBuf(bp)
+			b := append((*bp)[:0], head...)
+			b = appendOTLPRecord(b, keyvals, &opts)
+			b = append(b, "]}]}]}\n"...)
+			*bp = b
+			_, err := w.Write(b)
+			return err
+		}), nil
+	}
+}
+
+func appendOTLPRecord(b []byte, keyvals []interface{}, o *OTLPOpts) []byte {
+	now := time.Now()
+	ts := now
+	sev := otlpSeverities["info"]
+	sevSet := false
+	var body interface{}
+	hasBody := false
+	var traceID, spanID string
+	attrs := make([]interface{}, 0, len(keyvals))
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		var v interface{} = missingValue
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch k {
+		case o.MsgKey:
+			if !hasBody {
+				body, hasBody = v, true
+				continue
+			}
+		case o.LevelKey:
+			if s, ok := otlpSeverities[valueString(v)]; ok && !sevSet {
+				sev, sevSet = s, true
+				continue
+			}
+		case o.TimeKey:
+			if t, ok := v.(time.Time); ok {
+				ts = t
+				continue
+			}
+		case o.TraceIDKey:
+			if id, ok := otlpID(v, 16); ok && traceID == "" {
+				traceID = id
+				continue
+			}
+		case o.SpanIDKey:
+			if id, ok := otlpID(v, 8); ok && spanID == "" {
+				spanID = id
+				continue
+			}
+		}
+		attrs = append(attrs, k, v)
+	}
+
+	b = append(b, `{"timeUnixNano":"`...)
+	b = strconv.AppendInt(b, ts.UnixNano(), 10)
+	b = append(b, `","observedTimeUnixNano":"`...)
+	b = strconv.AppendInt(b, now.UnixNano(), 10)
+	b = append(b, `","severityNumber":`...)
+	b = strconv.AppendInt(b, int64(sev.num), 10)
+	b = append(b, `,"severityText":"`...)
+	b = append(b, sev.text...)
+	b = append(b, '"')
+	if hasBody {
+		b = append(b, `,"body":`...)
+		b = appendOTLPValue(b, body, 0)
+	}
+	b = append(b, `,"attributes":[`...)
+	for i := 0; i < len(attrs); i += 2 {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendOTLPKeyValue(b, attrs[i].(string), attrs[i+1], 0)
+	}
+	b = append(b, ']')
+	if traceID != "" {
+		b = append(b, `,"traceId":"`...)
+		b = append(b, traceID...)
+		b = append(b, '"')
+	}
+	if spanID != "" {
+		b = append(b, `,"spanId":"`...)
+		b = append(b, spanID...)
+		b = append(b, '"')
+	}
+	return append(b, '}')
+}
+
+// otlpID returns v as an n byte id in lower case hex
+func otlpID(v interface{}, n int) (string, bool) {
+	var id []byte
+	switch x := v.(type) {
+	case string:
+		b, err := hex.DecodeString(x)
+		if err != nil {
+			return "", false
+		}
+		id = b
+	case []byte:
+		id = x
+	case [16]byte:
+		id = x[:]
+	case [8]byte:
+		id = x[:]
+	default:
+		return "", false
+	}
+	if len(id) != n {
+		return "", false
+	}
+	return hex.EncodeToString(id), true
+}
+
+func appendOTLPKeyValue(b []byte, k string, v interface{}, depth int) []byte {
+	b = append(b, `{"key":`...)
+	b = appendJSONString(b, k)
+	b = append(b, `,"value":`...)
+	b = appendOTLPValue(b, v, depth)
+	return append(b, '}')
+}
+
+// appendOTLPKVList appends the entries of m, in key order, as a JSON
+// array of KeyValues
+func appendOTLPKVList(b []byte, m map[string]interface{}, depth int) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b = append(b, '[')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendOTLPKeyValue(b, k, m[k], depth)
+	}
+	return append(b, ']')
+}
+
+// appendOTLPValue appends v as an OTLP AnyValue
+func appendOTLPValue(b []byte, v interface{}, depth int) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, "{}"...)
+	case string:
+		return appendOTLPString(b, x)
+	case bool:
+		return append(strconv.AppendBool(append(b, `{"boolValue":`...), x), '}')
+	case int:
+		return appendOTLPInt(b, int64(x))
+	case int8:
+		return appendOTLPInt(b, int64(x))
+	case int16:
+		return appendOTLPInt(b, int64(x))
+	case int32:
+		return appendOTLPInt(b, int64(x))
+	case int64:
+		return appendOTLPInt(b, x)
+	case uint8:
+		return appendOTLPInt(b, int64(x))
+	case uint16:
+		return appendOTLPInt(b, int64(x))
+	case uint32:
+		return appendOTLPInt(b, int64(x))
+	case uint, uint64, uintptr:
+		u := reflect.ValueOf(x).Uint()
+		if u > math.MaxInt64 {
+			return appendOTLPString(b, strconv.FormatUint(u, 10))
+		}
+		return appendOTLPInt(b, int64(u))
+	case float32:
+		return appendOTLPDouble(b, float64(x), 32)
+	case float64:
+		return appendOTLPDouble(b, x, 64)
+	case []byte:
+		b = append(b, `{"bytesValue":"`...)
+		return append(appendBase64(b, x), `"}`...)
+	case time.Time:
+		return appendOTLPString(b, x.Format(time.RFC3339Nano))
+	case time.Duration:
+		return appendOTLPString(b, x.String())
+	case error, fmt.Stringer:
+		return appendOTLPString(b, valueString(x))
+	case map[string]interface{}:
+		if depth < maxBinDepth {
+			b = append(b, `{"kvlistValue":{"values":`...)
+			return append(appendOTLPKVList(b, x, depth+1), "}}"...)
+		}
+	}
+	if depth < maxBinDepth {
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array:
+			b = append(b, `{"arrayValue":{"values":[`...)
+			for i := 0; i < rv.Len(); i++ {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				b = appendOTLPValue(b, rv.Index(i).Interface(), depth+1)
+			}
+			return append(b, "]}}"...)
+		case reflect.Map:
+			m := make(map[string]interface{}, rv.Len())
+			iter := rv.MapRange()
+			for iter.Next() {
+				m[keyString(iter.Key().Interface())] = iter.Value().Interface()
+			}
+			b = append(b, `{"kvlistValue":{"values":`...)
+			return append(appendOTLPKVList(b, m, depth+1), "}}"...)
+		}
+	}
+	return appendOTLPString(b, valueString(v))
+}
+
+func appendOTLPString(b []byte, s string) []byte {
+	return append(appendJSONString(append(b, `{"stringValue":`...), s), '}')
+}
+
+// appendOTLPInt appends an intValue, which proto3 JSON writes as a
+// string
+func appendOTLPInt(b []byte, i int64) []byte {
+	b = append(b, `{"intValue":"`...)
+	b = strconv.AppendInt(b, i, 10)
+	return append(b, `"}`...)
+}
+
+func appendOTLPDouble(b []byte, f float64, bits int) []byte {
+	b = append(b, `{"doubleValue":`...)
+	switch {
+	case math.IsNaN(f):
+		b = append(b, `"NaN"`...)
+	case math.IsInf(f, 1):
+		b = append(b, `"Infinity"`...)
+	case math.IsInf(f, -1):
+		b = append(b, `"-Infinity"`...)
+	default:
+		b = appendJSONFloat(b, f, bits)
+	}
+	return append(b, '}')
+}
+
+// OTLPHTTPOpts configures an OTLPHTTPWriter.
+type OTLPHTTPOpts struct {
+	// URL is the collector's logs endpoint. Defaults to
+	// "http://localhost:4318/v1/logs".
+	URL string
+
+	// Headers are added to each request, e.g. for authorization.
+	Headers map[string]string
+
+	// BatchSize is the number of records that triggers a
+	// send. Defaults to 512.
+	BatchSize int
+
+	// FlushInterval is the longest a record waits before being
+	// sent. Defaults to 1s.
+	FlushInterval time.Duration
+
+	// Gzip compresses request bodies.
+	Gzip bool
+
+	// Client sends the requests. Defaults to an http.Client with a
+	// 10s timeout.
+	Client *http.Client
+}
+
+// OTLPHTTPWriterFac returns a WriterFac for an OTLPHTTPWriter.
+func OTLPHTTPWriterFac(opts OTLPHTTPOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewOTLPHTTPWriter(opts)
+	}
+}
+
+// OTLPHTTPWriter is an HTTPWriter that batches records written by an
+// OTLPSerializer and posts them to an OTLP/HTTP collector as
+// JSON. Records from the same resource and scope are merged into one
+// ExportLogsServiceRequest. Write fails for records that aren't
+// OTLP/JSON logs requests.
+type OTLPHTTPWriter struct {
+	*HTTPWriter
+}
+
+// NewOTLPHTTPWriter returns a new OTLPHTTPWriter.
+func NewOTLPHTTPWriter(opts OTLPHTTPOpts) (*OTLPHTTPWriter, error) {
+	if opts.URL == "" {
+		opts.URL = "http://localhost:4318/v1/logs"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 512
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	w, err := NewHTTPWriter(HTTPOpts{
+		URL:        opts.URL,
+		Headers:    opts.Headers,
+		Framing:    otlpFraming{},
+		MaxRecords: opts.BatchSize,
+		MaxLatency: opts.FlushInterval,
+		Gzip:       opts.Gzip,
+		Client:     opts.Client,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPHTTPWriter{w}, nil
+}
+
+// Write checks p is a JSON object with resourceLogs first, as
+// OTLPSerializer writes, leaving the decoding to the framing.
+func (o *OTLPHTTPWriter) Write(p []byte) (int, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(p), []byte(`{"resourceLogs":`)) || !json.Valid(p) {
+		return 0, errors.New("otlp: record is not an OTLP/JSON logs request")
+	}
+	return o.HTTPWriter.Write(p)
+}
+
+type otlpRequest struct {
+	ResourceLogs []struct {
+		Resource  json.RawMessage `json:"resource"`
+		ScopeLogs []struct {
+			Scope      json.RawMessage   `json:"scope"`
+			LogRecords []json.RawMessage `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+// otlpFraming merges OTLP/JSON records into one request
+type otlpFraming struct{}
+
+func (otlpFraming) ContentType() string { return "application/json" }
+
+func (otlpFraming) AppendBody(dst []byte, records []HTTPRecord) ([]byte, error) {
+	reqs := make([]otlpRequest, len(records))
+	for i, r := range records {
+		if err := json.Unmarshal(r.Data, &reqs[i]); err != nil {
+			return dst, err
+		}
+	}
+	return mergeOTLP(dst, reqs), nil
+}
+
+// mergeOTLP appends one request body with the log records of reqs
+// grouped by resource and scope, in first seen order
+func mergeOTLP(b []byte, reqs []otlpRequest) []byte {
+	type group struct {
+		resource, scope json.RawMessage
+		records         []json.RawMessage
+	}
+	var groups []*group
+	index := make(map[string]*group)
+	for _, req := range reqs {
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				key := string(rl.Resource) + "\x00" + string(sl.Scope)
+				g := index[key]
+				if g == nil {
+					g = &group{resource: rl.Resource, scope: sl.Scope}
+					index[key] = g
+					groups = append(groups, g)
+				}
+				g.records = append(g.records, sl.LogRecords...)
+			}
+		}
+	}
+
+	b = append(b, `{"resourceLogs":[`...)
+	for i := 0; i < len(groups); {
+		// consecutive groups with the same resource share a
+		// ResourceLogs
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, `{"resource":`...)
+		b = appendRaw(b, groups[i].resource)
+		b = append(b, `,"scopeLogs":[`...)
+		j := i
+		for ; j < len(groups) && bytes.Equal(groups[j].resource, groups[i].resource); j++ {
+			if j > i {
+				b = append(b, ',')
+			}
+			b = append(b, `{"scope":`...)
+			b = appendRaw(b, groups[j].scope)
+			b = append(b, `,"logRecords":[`...)
+			for k, r := range groups[j].records {
+				if k > 0 {
+					b = append(b, ',')
+				}
+				b = append(b, r...)
+			}
+			b = append(b, "]}"...)
+		}
+		b = append(b, "]}"...)
+		i = j
+	}
+	return append(b, "]}"...)
+}
+
+func appendRaw(b []byte, m json.RawMessage) []byte {
+	if len(m) == 0 {
+		return append(b, "{}"...)
+	}
+	return append(b, m...)
+}
@@ -0,0 +1,279 @@
+package logfu
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PatternOpts configures the Serializer returned by
+// PatternSerializerFac.
+type PatternOpts struct {
+	// Pattern is the line layout, e.g.
+	//
+	//	%{time} [%{LEVEL}] %{app}: %{msg} %{extra}
+	//
+	// It is made of text and these directives:
+	//
+	//	%{key}          the value of the key's keyval, empty if absent
+	//	%{time}         TimeKey's value, or the current time, in RFC 3339
+	//	%{time:LAYOUT}  the same in the given time.Format layout
+	//	%{level}        LevelKey's value
+	//	%{LEVEL}        LevelKey's value in upper case
+	//	%{extra}        keyvals not named elsewhere in the pattern, as
+	//	                space separated logfmt
+	//	%%              a literal %
+	//
+	// A width between the % and { pads the value with spaces, on
+	// the left or with a leading - on the right, like printf:
+	// %-5{LEVEL}.
+	Pattern string
+
+	// TimeKey and LevelKey default to "ts" and LevelKey.
+	TimeKey  string
+	LevelKey string
+}
+
+// PatternSerializerFac returns a SerializerFac for single line text
+// records laid out by opts.Pattern, for consumers that expect a
+// fixed format. The pattern is compiled once, when
+// PatternSerializerFac is called; the returned factory fails if it
+// is invalid. Control characters in values, such as newlines, are
+// escaped as in Go strings to keep records on one line. Trailing
+// spaces are trimmed from each line, so an empty %{extra} at the end
+// leaves no trace.
+func PatternSerializerFac(opts PatternOpts) func() (Serializer, error) {
+	if opts.TimeKey == "" {
+		opts.TimeKey = "ts"
+	}
+	if opts.LevelKey == "" {
+		opts.LevelKey = LevelKey
+	}
+	p, err := compilePattern(opts)
+	return func() (Serializer, error) {
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+type patternKind int
+
+const (
+	patText patternKind = iota
+	patKey
+	patTime
+	patLevel
+	patLEVEL
+	patExtra
+)
+
+type patternPart struct {
+	kind  patternKind
+	text  string // literal text, key or time layout
+	width int    // negative pads on the right
+}
+
+type patternSerializer struct {
+	parts    []patternPart
+	named    map[string]bool // keys not included in %{extra}
+	timeKey  string
+	levelKey string
+}
+
+func compilePattern(opts PatternOpts) (*patternSerializer, error) {
+	rv := &patternSerializer{
+		named:    map[string]bool{},
+		timeKey:  opts.TimeKey,
+		levelKey: opts.LevelKey,
+	}
+	s := opts.Pattern
+	var text strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			text.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '%' {
+			text.WriteByte('%')
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(s) && (s[j] == '-' || s[j] >= '0' && s[j] <= '9') {
+			j++
+		}
+		if j >= len(s) || s[j] != '{' {
+			return nil, fmt.Errorf("pattern %q: expected { after %% at %v", s, i)
+		}
+		width := 0
+		if j > i+1 {
+			w, err := strconv.Atoi(s[i+1 : j])
+			if err != nil {
+				return nil, fmt.Errorf("pattern %q: bad width at %v", s, i)
+			}
+			width = w
+		}
+		end := strings.IndexByte(s[j:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("pattern %q: unterminated %%{ at %v", s, i)
+		}
+		name := s[j+1 : j+end]
+		if name == "" {
+			return nil, fmt.Errorf("pattern %q: empty %%{} at %v", s, i)
+		}
+		if text.Len() > 0 {
+			rv.parts = append(rv.parts, patternPart{kind: patText, text: text.String()})
+			text.Reset()
+		}
+		p := patternPart{kind: patKey, text: name, width: width}
+		switch {
+		case name == "time":
+			p.kind, p.text = patTime, time.RFC3339
+			rv.named[opts.TimeKey] = true
+		case strings.HasPrefix(name, "time:"):
+			p.kind, p.text = patTime, name[len("time:"):]
+			rv.named[opts.TimeKey] = true
+		case name == "level":
+			p.kind = patLevel
+			rv.named[opts.LevelKey] = true
+		case name == "LEVEL":
+			p.kind = patLEVEL
+			rv.named[opts.LevelKey] = true
+		case name == "extra":
+			p.kind = patExtra
+		default:
+			rv.named[name] = true
+		}
+		rv.parts = append(rv.parts, p)
+		i = j + end
+	}
+	if text.Len() > 0 {
+		rv.parts = append(rv.parts, patternPart{kind: patText, text: text.String()})
+	}
+	return rv, nil
+}
+
+func (o *patternSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	bp := getBuf()
+	defer putBuf(bp)
+	b := (*bp)[:0]
+	for _, p := range o.parts {
+		start := len(b)
+		switch p.kind {
+		case patText:
+			b = append(b, p.text...)
+			continue
+		case patKey:
+			if v, ok := lookup(keyvals, p.text); ok {
+				b = appendText(b, valueString(v))
+			}
+		case patTime:
+			v, _ := lookup(keyvals, o.timeKey)
+			switch t := v.(type) {
+			case time.Time:
+				b = t.AppendFormat(b, p.text)
+			case nil:
+				b = time.Now().AppendFormat(b, p.text)
+			default:
+				b = appendText(b, valueString(t))
+			}
+		case patLevel, patLEVEL:
+			if v, ok := lookup(keyvals, o.levelKey); ok {
+				s := valueString(v)
+				if p.kind == patLEVEL {
+					s = strings.ToUpper(s)
+				}
+				b = appendText(b, s)
+			}
+		case patExtra:
+			b = o.appendExtra(b, keyvals)
+		}
+		b = pad(b, start, p.width)
+	}
+	for len(b) > 0 && b[len(b)-1] == ' ' {
+		b = b[:len(b)-1]
+	}
+	b = append(b, '\n')
+	*bp = b
+	_, err := w.Write(b)
+	return err
+}
+
+// appendExtra appends the keyvals not named in the pattern as
+// logfmt
+func (o *patternSerializer) appendExtra(b []byte, keyvals []interface{}) []byte {
+	first := true
+	for i := 0; i < len(keyvals); i += 2 {
+		k := keyString(keyvals[i])
+		if o.named[k] {
+			continue
+		}
+		if !first {
+			b = append(b, ' ')
+		}
+		first = false
+		b = appendLogfmtString(b, k)
+		b = append(b, '=')
+		if i+1 < len(keyvals) {
+			b = appendLogfmtString(b, valueString(keyvals[i+1]))
+		} else {
+			b = appendLogfmtString(b, missingValue)
+		}
+	}
+	return b
+}
+
+// appendText appends s with control characters escaped, as in Go
+// strings, so a value can't split the record across lines
+func appendText(b []byte, s string) []byte {
+	if strings.IndexFunc(s, isControl) < 0 {
+		return append(b, s...)
+	}
+	for _, r := range s {
+		switch {
+		case r == '\n':
+			b = append(b, `\n`...)
+		case r == '\r':
+			b = append(b, `\r`...)
+		case r == '\t':
+			b = append(b, `\t`...)
+		case isControl(r):
+			b = append(b, fmt.Sprintf(`\x%02x`, r)...)
+		default:
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return b
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+// pad pads b[start:] with spaces to |width| runes, on the left for
+// positive widths and the right for negative ones
+func pad(b []byte, start, width int) []byte {
+	left := width > 0
+	if width < 0 {
+		width = -width
+	}
+	n := width - utf8.RuneCount(b[start:])
+	if n <= 0 {
+		return b
+	}
+	for i := 0; i < n; i++ {
+		b = append(b, ' ')
+	}
+	if left {
+		copy(b[start+n:], b[start:len(b)-n])
+		for i := start; i < start+n; i++ {
+			b[i] = ' '
+		}
+	}
+	return b
+}
@@ -0,0 +1,274 @@
+package logfu
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// RateLimitOpts configures the Filterer returned by
+// RateLimitFilterFac.
+type RateLimitOpts struct {
+	// Keys names the keyvals whose values identify "similar"
+	// records for rate limiting, e.g. "msg" and "err". Defaults to
+	// {"msg", "err"} if empty.
+	Keys []string
+
+	// Rate is the number of records per second allowed for each
+	// distinct key once its Burst is used up. Zero or less turns
+	// rate limiting off.
+	Rate float64
+
+	// Burst is the token bucket size for each distinct key. Values
+	// less than 1 are treated as 1.
+	Burst int
+
+	// DedupWindow suppresses records identical in all keyvals to
+	// one that passed less than DedupWindow ago. Zero turns
+	// de-duplication off.
+	DedupWindow time.Duration
+
+	// Emit, if non-nil, receives a summary record every
+	// SummaryInterval for each key that had records
+	// suppressed. If nil, the suppressed count is appended to the
+	// next record for that key that passes the filter instead.
+	// Don't pass a log2 func that feeds back into this filter.
+	Emit func(keyvals ...interface{}) error
+
+	// SummaryInterval is how often summaries are sent to
+	// Emit. Defaults to one minute.
+	SummaryInterval time.Duration
+
+	// SuppressedKey is the key used for the suppressed record
+	// count. Defaults to "suppressed".
+	SuppressedKey string
+
+	// MaxKeys bounds the number of distinct keys and record
+	// fingerprints tracked. Defaults to 10000. When it is reached
+	// and no state can be discarded without affecting filtering,
+	// the oldest key is dropped, along with its suppressed count.
+	MaxKeys int
+}
+
+// RateLimitFilterFac returns a FiltererFac for a Filterer that
+// rate-limits records per key with a token bucket, drops exact
+// duplicates within a window and reports how many records it
+// suppressed. The returned Filterer is also an io.Closer that stops
+// its summary goroutine, so it is shut down when a mode change
+// discards it.
+func RateLimitFilterFac(opts RateLimitOpts) func() (Filterer, error) {
+	return func() (Filterer, error) {
+		return NewRateLimitFilter(opts), nil
+	}
+}
+
+// RateLimitFilter is the Filterer created by RateLimitFilterFac
+type RateLimitFilter struct {
+	opts    RateLimitOpts
+	mutex   sync.Mutex
+	buckets map[string]*rlBucket
+	seen    map[uint64]time.Time
+	stopCh  chan struct{}
+	once    sync.Once
+}
+
+// per-key limiter state
+type rlBucket struct {
+	tokens     float64
+	last       time.Time
+	suppressed int
+	keyvals    []interface{} // the key's keyvals, for summaries
+}
+
+// NewRateLimitFilter returns a RateLimitFilter using the given
+// options, starting its summary goroutine if opts.Emit is set.
+func NewRateLimitFilter(opts RateLimitOpts) *RateLimitFilter {
+	if len(opts.Keys) == 0 {
+		opts.Keys = []string{"msg", "err"}
+	}
+	if opts.Burst < 1 {
+		opts.Burst = 1
+	}
+	if opts.SummaryInterval <= 0 {
+		opts.SummaryInterval = time.Minute
+	}
+	if opts.SuppressedKey == "" {
+		opts.SuppressedKey = "suppressed"
+	}
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = 10000
+	}
+	rv := &RateLimitFilter{
+		opts:    opts,
+		buckets: make(map[string]*rlBucket),
+		seen:    make(map[uint64]time.Time),
+		stopCh:  make(chan struct{}),
+	}
+	if opts.Emit != nil {
+		go rv.summarize()
+	}
+	return rv
+}
+
+func (o *RateLimitFilter) Filter(keyvals []interface{}) ([]interface{}, error) {
+	now := time.Now()
+	key, kkvs := o.key(keyvals)
+
+	o.mutex.Lock()
+	b := o.buckets[key]
+	if b == nil {
+		if len(o.buckets) >= o.opts.MaxKeys {
+			o.prune(now)
+			if len(o.buckets) >= o.opts.MaxKeys {
+				o.evictOldest()
+			}
+		}
+		b = &rlBucket{tokens: float64(o.opts.Burst), last: now, keyvals: kkvs}
+		o.buckets[key] = b
+	}
+
+	if o.opts.DedupWindow > 0 {
+		fp := fingerprint(keyvals)
+		if t, ok := o.seen[fp]; ok && now.Sub(t) < o.opts.DedupWindow {
+			b.suppressed++
+			o.mutex.Unlock()
+			return nil, nil
+		}
+		if len(o.seen) >= o.opts.MaxKeys {
+			o.prune(now)
+		}
+		o.seen[fp] = now
+	}
+
+	if o.opts.Rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * o.opts.Rate
+		if max := float64(o.opts.Burst); b.tokens > max {
+			b.tokens = max
+		}
+		b.last = now
+		if b.tokens < 1 {
+			b.suppressed++
+			o.mutex.Unlock()
+			return nil, nil
+		}
+		b.tokens--
+	}
+
+	n := 0
+	if o.opts.Emit == nil {
+		n = b.suppressed
+		b.suppressed = 0
+	}
+	o.mutex.Unlock()
+
+	if n == 0 {
+		return keyvals, nil
+	}
+	rv := make([]interface{}, len(keyvals), len(keyvals)+2)
+	copy(rv, keyvals)
+	return append(rv, o.opts.SuppressedKey, n), nil
+}
+
+// Close stops the summary goroutine, if any. It does not emit a
+// final summary.
+func (o *RateLimitFilter) Close() error {
+	o.once.Do(func() { close(o.stopCh) })
+	return nil
+}
+
+// key returns the limiter key for the given record and the keyvals
+// it was made from.
+func (o *RateLimitFilter) key(keyvals []interface{}) (string, []interface{}) {
+	var kkvs []interface{}
+	key := ""
+	for _, k := range o.opts.Keys {
+		if v, ok := lookup(keyvals, k); ok {
+			kkvs = append(kkvs, k, v)
+			key += fmt.Sprint(v)
+		}
+		key += "\x00"
+	}
+	return key, kkvs
+}
+
+// prune discards state that no longer affects filtering. Must hold
+// o.mutex.
+func (o *RateLimitFilter) prune(now time.Time) {
+	for k, t := range o.seen {
+		if now.Sub(t) >= o.opts.DedupWindow {
+			delete(o.seen, k)
+		}
+	}
+	if len(o.seen) >= o.opts.MaxKeys {
+		o.seen = make(map[uint64]time.Time)
+	}
+	for k, b := range o.buckets {
+		if b.suppressed != 0 {
+			continue
+		}
+		if o.opts.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*o.opts.Rate >= float64(o.opts.Burst) {
+			delete(o.buckets, k)
+		}
+	}
+}
+
+// evictOldest discards the bucket least recently refilled, or
+// created if Rate is off. Must hold o.mutex.
+func (o *RateLimitFilter) evictOldest() {
+	var oldest string
+	var t time.Time
+	for k, b := range o.buckets {
+		if t.IsZero() || b.last.Before(t) {
+			oldest, t = k, b.last
+		}
+	}
+	delete(o.buckets, oldest)
+}
+
+// summarize sends a summary record to opts.Emit for each key with
+// suppressed records every opts.SummaryInterval until Close is
+// called.
+func (o *RateLimitFilter) summarize() {
+	t := time.NewTicker(o.opts.SummaryInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.stopCh:
+			return
+		case <-t.C:
+		}
+		var recs [][]interface{}
+		o.mutex.Lock()
+		for _, b := range o.buckets {
+			if b.suppressed == 0 {
+				continue
+			}
+			kv := []interface{}{
+				"msg", fmt.Sprintf("suppressed %d similar records", b.suppressed),
+				o.opts.SuppressedKey, b.suppressed,
+			}
+			for i := 0; i+1 < len(b.keyvals); i += 2 {
+				kv = append(kv, "similar_"+b.keyvals[i].(string), b.keyvals[i+1])
+			}
+			recs = append(recs, kv)
+			b.suppressed = 0
+		}
+		o.mutex.Unlock()
+
+		// emit outside the lock in case Emit ends up back here
+		for _, kv := range recs {
+			o.opts.Emit(kv...)
+		}
+	}
+}
+
+// fingerprint hashes all keyvals of a record
+func fingerprint(keyvals []interface{}) uint64 {
+	h := fnv.New64a()
+	for _, v := range keyvals {
+		fmt.Fprint(h, v)
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
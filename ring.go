@@ -0,0 +1,183 @@
+package logfu
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/msample/log2"
+)
+
+// Dumper is implemented by writers that hold records until asked to
+// write them out, like RingWriter. Config.DumpWriters calls it.
+type Dumper interface {
+	Dump() error
+}
+
+// RingOpts configures a RingWriter.
+type RingOpts struct {
+	// MaxRecords and MaxBytes bound the records held; the oldest
+	// are dropped to make room. They default to 1000 and 1MiB.
+	MaxRecords int
+	MaxBytes   int
+
+	// DumpTo makes the writer dumps go to, when first needed.
+	DumpTo func() (io.Writer, error)
+
+	// TriggerLevels, if set, dumps the buffer when a record logged
+	// at one of these levels, e.g. log2.ERROR, is written, after
+	// adding it. The level comes from the log func, via WriteLevel,
+	// so it works with any serializer.
+	TriggerLevels []log2.Level
+
+	// TriggerOnce stops triggering after the first dump, to
+	// capture what led up to the first error only.
+	TriggerOnce bool
+
+	// DumpOnClose dumps the buffer when the writer is closed,
+	// e.g. by a mode change that doesn't use it.
+	DumpOnClose bool
+}
+
+// RingWriterFac returns a WriterFac for a RingWriter.
+func RingWriterFac(opts RingOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewRingWriter(opts), nil
+	}
+}
+
+// RingWriter keeps the most recent records in memory rather than
+// writing them, so DEBUG records can be routed to it cheaply and only
+// written out, by Dump, when something goes wrong. Dump writes the
+// held records, oldest first, one Write each, and empties the
+// buffer. Config.DumpWriters dumps the current mode's RingWriters,
+// and Config.SetDumpSignal has a signal do it. Safe for concurrent
+// use.
+type RingWriter struct {
+	opts     RingOpts
+	mutex    sync.Mutex
+	recs     [][]byte // circular
+	head     int      // index of the oldest record
+	n        int
+	size     int
+	dst      io.Writer
+	triggers map[log2.Level]bool
+	disarmed bool
+}
+
+// NewRingWriter returns a new RingWriter
+func NewRingWriter(opts RingOpts) *RingWriter {
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 1000
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 1 << 20
+	}
+	rv := &RingWriter{opts: opts, recs: make([][]byte, opts.MaxRecords)}
+	if len(opts.TriggerLevels) > 0 {
+		rv.triggers = make(map[log2.Level]bool)
+		for _, l := range opts.TriggerLevels {
+			rv.triggers[l] = true
+		}
+	}
+	return rv
+}
+
+// Write adds a record without a level, so it never triggers a dump.
+func (o *RingWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.add(p)
+	return len(p), nil
+}
+
+// WriteLevel adds a record logged at level l, dumping the buffer if
+// l is one of the TriggerLevels. Log funcs call it rather than Write.
+func (o *RingWriter) WriteLevel(l log2.Level, p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.add(p)
+	if o.triggers[l] && !o.disarmed {
+		o.disarmed = o.opts.TriggerOnce
+		if err := o.dumpLocked(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// add keeps a copy of p, dropping the oldest records to make room.
+// Called with mutex held.
+func (o *RingWriter) add(p []byte) {
+
+	// records bigger than MaxBytes aren't kept
+	if len(p) <= o.opts.MaxBytes {
+		for o.n > 0 && (o.n == len(o.recs) || o.size+len(p) > o.opts.MaxBytes) {
+			o.size -= len(o.recs[o.head])
+			o.recs[o.head] = nil
+			o.head = (o.head + 1) % len(o.recs)
+			o.n--
+		}
+		i := (o.head + o.n) % len(o.recs)
+		o.recs[i] = append([]byte(nil), p...)
+		o.n++
+		o.size += len(p)
+	}
+}
+
+// Len returns the number of records held.
+func (o *RingWriter) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.n
+}
+
+// Dump writes the held records to the DumpTo writer and empties the
+// buffer.
+func (o *RingWriter) Dump() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.dumpLocked()
+}
+
+func (o *RingWriter) dumpLocked() error {
+	if o.dst == nil {
+		if o.opts.DumpTo == nil {
+			return errors.New("ring writer: no DumpTo writer")
+		}
+		w, err := o.opts.DumpTo()
+		if err != nil {
+			return err
+		}
+		o.dst = w
+	}
+	var rv error
+	for ; o.n > 0; o.n-- {
+		if _, err := o.dst.Write(o.recs[o.head]); err != nil && rv == nil {
+			rv = err
+		}
+		o.size -= len(o.recs[o.head])
+		o.recs[o.head] = nil
+		o.head = (o.head + 1) % len(o.recs)
+	}
+	return rv
+}
+
+// Close dumps the buffer if DumpOnClose is set and closes the DumpTo
+// writer if it is an io.Closer.
+func (o *RingWriter) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var rv error
+	if o.opts.DumpOnClose && o.n > 0 {
+		rv = o.dumpLocked()
+	}
+	if c, ok := o.dst.(io.Closer); ok {
+		if err := c.Close(); err != nil && rv == nil {
+			rv = err
+		}
+	}
+	o.dst = nil
+	return rv
+}
@@ -0,0 +1,133 @@
+package logfu
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SampleOpts configures the Filterer returned by SampleFilterFac.
+//
+// If First or Thereafter is set the filter counts records: the first
+// First records in each Interval are kept, then every Thereafter'th
+// record after that. Otherwise Rate is the fraction of records kept
+// (0.01 keeps 1%), chosen at random unless HashKey is set.
+type SampleOpts struct {
+	// Rate is the fraction of records to keep, above 0 and up to
+	// 1. It must be set unless First or Thereafter is.
+	Rate float64
+
+	// HashKey, if set, makes Rate sampling deterministic on the
+	// value of that keyval (e.g. "trace_id") so all records
+	// sharing the value are either kept or dropped
+	// together. Records without the key are sampled at random.
+	HashKey string
+
+	// First is the number of records kept per Interval before
+	// switching to every Thereafter'th record.
+	First int
+
+	// Thereafter keeps every Thereafter'th record once First is
+	// used up in the current Interval. Zero drops them all.
+	Thereafter int
+
+	// Interval is the counting period for First and
+	// Thereafter. Defaults to one second.
+	Interval time.Duration
+
+	// RateKey, if set, is appended to kept records with the
+	// sampling rate that applied to them so downstream counts can
+	// be re-weighted.
+	RateKey string
+}
+
+// SampleFilterFac returns a FiltererFac for a Filterer that keeps
+// a sample of the records given to it per opts.
+func SampleFilterFac(opts SampleOpts) func() (Filterer, error) {
+	return func() (Filterer, error) {
+		return NewSampleFilter(opts)
+	}
+}
+
+// SampleFilter is the Filterer created by SampleFilterFac
+type SampleFilter struct {
+	opts  SampleOpts
+	mutex sync.Mutex
+	start time.Time
+	count int
+}
+
+// NewSampleFilter returns a SampleFilter using the given options.
+func NewSampleFilter(opts SampleOpts) (*SampleFilter, error) {
+	if opts.Rate < 0 || opts.Rate > 1 {
+		return nil, fmt.Errorf("sample rate out of range [0,1]: %v", opts.Rate)
+	}
+	if opts.First < 0 || opts.Thereafter < 0 {
+		return nil, fmt.Errorf("sample First and Thereafter may not be negative")
+	}
+	if opts.Rate == 0 && opts.First == 0 && opts.Thereafter == 0 {
+		return nil, fmt.Errorf("sample rate is 0, which drops every record")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	return &SampleFilter{opts: opts}, nil
+}
+
+func (o *SampleFilter) Filter(keyvals []interface{}) ([]interface{}, error) {
+	var keep bool
+	var rate float64
+	if o.opts.First > 0 || o.opts.Thereafter > 0 {
+		keep, rate = o.counted()
+	} else {
+		keep, rate = o.sampled(keyvals), o.opts.Rate
+	}
+	if !keep {
+		return nil, nil
+	}
+	if o.opts.RateKey == "" {
+		return keyvals, nil
+	}
+	rv := make([]interface{}, len(keyvals), len(keyvals)+2)
+	copy(rv, keyvals)
+	return append(rv, o.opts.RateKey, rate), nil
+}
+
+// counted applies first-N-then-every-Mth sampling
+func (o *SampleFilter) counted() (bool, float64) {
+	now := time.Now()
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if now.Sub(o.start) >= o.opts.Interval {
+		o.start = now
+		o.count = 0
+	}
+	o.count++
+	if o.count <= o.opts.First {
+		return true, 1
+	}
+	if o.opts.Thereafter > 0 && (o.count-o.opts.First)%o.opts.Thereafter == 0 {
+		return true, 1 / float64(o.opts.Thereafter)
+	}
+	return false, 0
+}
+
+// sampled applies Rate sampling, by hash of HashKey's value if the
+// record has it.
+func (o *SampleFilter) sampled(keyvals []interface{}) bool {
+	if o.opts.Rate >= 1 {
+		return true
+	}
+	if o.opts.HashKey != "" {
+		if v, ok := lookup(keyvals, o.opts.HashKey); ok {
+			h := fnv.New64a()
+			fmt.Fprint(h, v)
+			return float64(h.Sum64())/math.MaxUint64 < o.opts.Rate
+		}
+	}
+	return rand.Float64() < o.opts.Rate
+}
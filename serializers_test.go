@@ -0,0 +1,462 @@
+package logfu_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/msample/log2"
+	"github.com/msample/logfu"
+)
+
+func TestFastJSONSerialize(t *testing.T) {
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 123, time.UTC)
+	kvs := []interface{}{
+		"msg", "hi \"there\"\n\t<&> \x01",
+		"n", 42, "u", uint8(7), "f", 1.5, "big", 1e21, "small", 1e-7, "f32", float32(0.1),
+		"ok", true, "nil", nil, "ts", ts, "d", 1500 * time.Millisecond,
+		"err", errors.New("boom"), "b", []byte("bytes"),
+		"slice", []int{1, 2}, "map", map[string]int{"a": 1},
+	}
+	var fast, std bytes.Buffer
+	if err := logfu.FastJSONSerialize(&fast, kvs); err != nil {
+		t.Fatal(err)
+	}
+	if err := logfu.JSONSerialize(&std, kvs); err != nil {
+		t.Fatal(err)
+	}
+	var fm, sm map[string]interface{}
+	if err := json.Unmarshal(fast.Bytes(), &fm); err != nil {
+		t.Fatalf("invalid JSON %q: %v", fast.String(), err)
+	}
+	json.Unmarshal(std.Bytes(), &sm)
+	if !reflect.DeepEqual(fm, sm) {
+		t.Errorf("FastJSONSerialize differs from JSONSerialize:\n%s%s", fast.String(), std.String())
+	}
+	if !bytes.HasPrefix(fast.Bytes(), []byte(`{"msg":`)) || !bytes.HasSuffix(fast.Bytes(), []byte("}\n")) {
+		t.Errorf("expected keyval order and trailing newline: %q", fast.String())
+	}
+
+	fast.Reset()
+	logfu.FastJSONSerialize(&fast, []interface{}{"nan", math.NaN(), "odd"})
+	if got := fast.String(); got != `{"nan":"NaN","odd":"(MISSING)"}`+"\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	// nil pointer Marshalers, as encoding/json does
+	fast.Reset()
+	var ip *netip.Addr
+	if err := logfu.FastJSONSerialize(&fast, []interface{}{"t", (*time.Time)(nil), "ip", ip}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fast.String(); got != `{"t":null,"ip":null}`+"\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+}
+
+var benchKeyvals = []interface{}{
+	"ts", time.Now(), "level", "info", "msg", "request handled",
+	"path", "/api/v1/things", "status", 200, "dur", 1234 * time.Microsecond,
+	"bytes", 5123, "ratio", 0.25, "err", errors.New("none"),
+}
+
+func BenchmarkJSONSerialize(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logfu.JSONSerialize(io.Discard, benchKeyvals)
+	}
+}
+
+func BenchmarkFastJSONSerialize(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logfu.FastJSONSerialize(io.Discard, benchKeyvals)
+	}
+}
+
+func TestConsoleSerializer(t *testing.T) {
+	s, err := logfu.ConsoleSerializerFac(logfu.ConsoleOpts{MsgWidth: 12})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	err = s.Serialize(&buf, []interface{}{
+		"ts", ts, "level", "error", "msg", "boom", "addr", "db:5432",
+		"err", "dial failed", "err.stack", "main.main\n\t/src/main.go:12\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "10:00:00.000 ERROR boom         addr=db:5432 err=\"dial failed\"\n" +
+		"    err.stack:\n" +
+		"        main.main\n" +
+		"        \t/src/main.go:12\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	s, _ = logfu.ConsoleSerializerFac(logfu.ConsoleOpts{Color: logfu.ColorAlways})()
+	buf.Reset()
+	s.Serialize(&buf, []interface{}{"level", "warn", "msg", "careful"})
+	if !bytes.Contains(buf.Bytes(), []byte("\x1b[33mWARN\x1b[0m")) {
+		t.Errorf("expected colored level: %q", buf.String())
+	}
+
+	// /dev/null is a character device but not a terminal
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	fw := &fdWriter{f: null}
+	s, _ = logfu.ConsoleSerializerFac(logfu.ConsoleOpts{})()
+	s.Serialize(fw, []interface{}{"level", "error", "msg", "boom"})
+	if strings.Contains(fw.String(), "\x1b[") {
+		t.Errorf("expected no colors for %v: %q", os.DevNull, fw.String())
+	}
+}
+
+// fdWriter keeps what's written and reports f's descriptor
+type fdWriter struct {
+	bytes.Buffer
+	f *os.File
+}
+
+func (o *fdWriter) Fd() uintptr { return o.f.Fd() }
+
+func TestGELFSerializer(t *testing.T) {
+	s, err := logfu.GELFSerializerFac(logfu.GELFOpts{Host: "h1", FullMsgKey: "stack"})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 500e6, time.UTC)
+	var buf bytes.Buffer
+	err = s.Serialize(&buf, []interface{}{
+		"ts", ts, "level", "error", "msg", "boom", "stack", "a\nb",
+		"id", 7, "user name", "bob", "ok", true, "ratio", 0.5, "num_str", "12",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"version":"1.1","host":"h1","short_message":"boom","full_message":"a\nb",` +
+		`"timestamp":1792317600.5,"level":3,"_id_":7,"_user_name":"bob","_ok":"true","_ratio":0.5,"_num_str":"12"}`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestECSSerializer(t *testing.T) {
+	s, err := logfu.ECSSerializerFac(logfu.ECSOpts{
+		Mapping:        map[string]string{"tenant": "organization.name", "host": ""},
+		UnmappedPrefix: "labels.",
+	})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.FixedZone("X", 3600))
+	var buf bytes.Buffer
+	err = s.Serialize(&buf, []interface{}{
+		"ts", ts, "level", "error", "msg", "boom", "err", errors.New("EOF"),
+		"err.type", "*errors.errorString", "service", "billing", "tenant", "acme",
+		"host", "h1", "n", 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"@timestamp":"2026-10-18T09:00:00Z","log":{"level":"error"},"message":"boom",` +
+		`"error":{"message":"EOF","type":"*errors.errorString"},"service":{"name":"billing"},` +
+		`"organization":{"name":"acme"},"labels":{"host":"h1","n":3},"ecs":{"version":"8.11.0"}}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestCEFSerializer(t *testing.T) {
+	s, err := logfu.CEFSerializerFac(logfu.CEFOpts{Vendor: "Acme", Product: "Bill|ing", Version: "1.2"})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 0)
+	var buf bytes.Buffer
+	s.Serialize(&buf, []interface{}{
+		"level", "audit", "event", "login", "msg", `user \ logged in`,
+		"ts", ts, "user", "bob", "note", "a=b\nc", "odd-key", 1,
+	})
+	want := `CEF:0|Acme|Bill\|ing|1.2|login|user \\ logged in|5|rt=1700000000000 suser=bob note=a\=b\nc oddkey=1` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestLEEFSerializer(t *testing.T) {
+	s, err := logfu.LEEFSerializerFac(logfu.LEEFOpts{Vendor: "Acme", Product: "Billing", Version: "1.2"})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	s.Serialize(&buf, []interface{}{"event", "login", "severity", 9, "user", "bob", "msg", "tab\there"})
+	want := "LEEF:2.0|Acme|Billing|1.2|login|sev=9\tusrName=bob\tmsg=tab\\there\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	s, _ = logfu.LEEFSerializerFac(logfu.LEEFOpts{Vendor: "A", Product: "B", Version: "1", Delimiter: '^'})()
+	buf.Reset()
+	s.Serialize(&buf, []interface{}{"level", "error", "x", "1^2"})
+	want = "LEEF:2.0|A|B|1|0|^|sev=8^x=1\\^2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestPatternSerializer(t *testing.T) {
+	s, err := logfu.PatternSerializerFac(logfu.PatternOpts{
+		Pattern: "%{time} [%-5{LEVEL}] %{app}: %{msg} %{extra}",
+	})()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	s.Serialize(&buf, []interface{}{"ts", ts, "level", "warn", "app", "myapp", "msg", "message", "key", "val", "q", "a b"})
+	s.Serialize(&buf, []interface{}{"ts", ts, "level", "error", "app", "myapp", "msg", "no extras"})
+	want := "2026-10-18T10:00:00Z [WARN ] myapp: message key=val q=\"a b\"\n" +
+		"2026-10-18T10:00:00Z [ERROR] myapp: no extras\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	s, _ = logfu.PatternSerializerFac(logfu.PatternOpts{Pattern: "%{time:15:04} %5{n}%% %{missing}|"})()
+	buf.Reset()
+	s.Serialize(&buf, []interface{}{"ts", ts, "n", 42})
+	if got := buf.String(); got != "10:00    42% |\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	// values can't split the record or forge another
+	s, _ = logfu.PatternSerializerFac(logfu.PatternOpts{Pattern: "%{LEVEL} %{msg}"})()
+	buf.Reset()
+	s.Serialize(&buf, []interface{}{"level", "info\r", "msg", "ok\nERROR forged\t\x1b[31m"})
+	if got := buf.String(); got != "INFO\\r ok\\nERROR forged\\t\\x1b[31m\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	for _, bad := range []string{"%{", "%{}", "%x", "%5"} {
+		if _, err := logfu.PatternSerializerFac(logfu.PatternOpts{Pattern: bad})(); err == nil {
+			t.Errorf("expected error for pattern %q", bad)
+		}
+	}
+}
+
+func TestStrictLogfmtSerializer(t *testing.T) {
+	s, _ := logfu.StrictLogfmtSerializerFac(logfu.LogfmtOpts{
+		Pinned:      []string{"ts", "level", "msg"},
+		Sort:        true,
+		Flatten:     true,
+		FloatFormat: 'f',
+		FloatPrec:   2,
+		TimeFormat:  time.RFC3339,
+	})()
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	s.Serialize(&buf, []interface{}{
+		"zed", 1, "msg", "hello world", "req", map[string]interface{}{"path": "/x", "code": 200},
+		"ts", ts, "ids", []int{7, 8}, "lat", 1.5, "bad key", "a=b", "level", "info", "utf", "\xff", "odd",
+	})
+	want := `ts=2026-10-18T10:00:00Z level=info msg="hello world" bad_key="a=b" ids.0=7 ids.1=8 ` +
+		`lat=1.50 odd=(MISSING) req.code=200 req.path=/x utf="` + "\ufffd" + `" zed=1` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+
+	s, _ = logfu.StrictLogfmtSerializerFac(logfu.LogfmtOpts{Pinned: []string{"msg"}})()
+	buf.Reset()
+	s.Serialize(&buf, []interface{}{"b", "", "a", "line\nbreak", "msg", "m", "m", map[string]int{"k": 1}})
+	want = `msg=m b="" a="line\nbreak" m=map[k:1]` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestOTLPSerializer(t *testing.T) {
+	s, _ := logfu.OTLPSerializerFac(logfu.OTLPOpts{
+		Resource: map[string]interface{}{"service.name": "billing"},
+	})()
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	err := s.Serialize(&buf, []interface{}{"ts", ts, "level", "warn", "msg", "slow",
+		"trace_id", "0af7651916cd43dd8448eb211c80319c", "span_id", "b7ad6b7169203331",
+		"n", 3, "lat", 1.5, "tags", []string{"a", "b"}, "req", map[string]interface{}{"path": "/x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		ResourceLogs []struct {
+			Resource  map[string]interface{}
+			ScopeLogs []struct {
+				LogRecords []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, buf.Bytes())
+	}
+	res, _ := json.Marshal(got.ResourceLogs[0].Resource)
+	if string(res) != `{"attributes":[{"key":"service.name","value":{"stringValue":"billing"}}]}` {
+		t.Errorf("unexpected resource %s", res)
+	}
+	r := got.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	delete(r, "observedTimeUnixNano")
+	b, _ := json.Marshal(r)
+	want := `{"attributes":[{"key":"n","value":{"intValue":"3"}},{"key":"lat","value":{"doubleValue":1.5}},` +
+		`{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"stringValue":"b"}]}}},` +
+		`{"key":"req","value":{"kvlistValue":{"values":[{"key":"path","value":{"stringValue":"/x"}}]}}}],` +
+		`"body":{"stringValue":"slow"},"severityNumber":13,"severityText":"WARN","spanId":"b7ad6b7169203331",` +
+		`"timeUnixNano":"1792317600000000000","traceId":"0af7651916cd43dd8448eb211c80319c"}`
+	if string(b) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b, want)
+	}
+}
+
+func TestJournaldSerializer(t *testing.T) {
+	s, _ := logfu.JournaldSerializerFac(logfu.JournaldOpts{Identifier: "app"})()
+	var buf bytes.Buffer
+	s.Serialize(&buf, []interface{}{"level", "warn", "msg", "hi", "req.id", 7, "_secret", "x", "9k", "v", "trace", "a\nb"})
+	want := "LEVEL=warn\nMESSAGE=hi\nREQ_ID=7\nSECRET=x\nF9K=v\nTRACE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n" +
+		"PRIORITY=4\nSYSLOG_IDENTIFIER=app\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestJournaldSerializerLevel(t *testing.T) {
+	// the level comes from the log func, without SetLevelKey
+	fac := logfu.JournaldSerializerFac(logfu.JournaldOpts{Identifier: "app"})
+	for l, want := range map[log2.Level]string{log2.ERROR: "3", log2.WARN: "4", log2.DEBUG: "7"} {
+		got := logAt(t, fac, l, "msg", "hi")
+		if !strings.Contains(got, "\nPRIORITY="+want+"\n") {
+			t.Errorf("expected priority %v for %v, got %q", want, logfu.LevelName(l), got)
+		}
+	}
+}
+
+func TestGELFSerializerLevel(t *testing.T) {
+	// the level comes from the log func, without SetLevelKey
+	fac := logfu.GELFSerializerFac(logfu.GELFOpts{Host: "h"})
+	for l, want := range map[log2.Level]string{log2.ERROR: "3", log2.WARN: "4", log2.DEBUG: "7"} {
+		got := logAt(t, fac, l, "msg", "hi")
+		if !strings.Contains(got, `"level":`+want+`,`) && !strings.Contains(got, `"level":`+want+`}`) {
+			t.Errorf("expected level %v for %v, got %q", want, logfu.LevelName(l), got)
+		}
+	}
+}
+
+// logAt logs keyvals at level l through a Config using the
+// serializers made by sf, returning the output
+func logAt(t *testing.T, sf logfu.SerializerFac, l log2.Level, keyvals ...interface{}) string {
+	var buf bytes.Buffer
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{sf},
+		[]logfu.WriterFac{func() (io.Writer, error) { return &buf, nil }},
+		[]logfu.Mode{{l: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg := logfu.NewLogger()
+	lf.SetLogger(lg)
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = lg.Log(l, keyvals...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestTruncateSerializer(t *testing.T) {
+	long := strings.Repeat("é", 600)
+	kv := []interface{}{"msg", long, "err", errors.New(strings.Repeat("x", 200)), "n", 42, "k", "short"}
+
+	s, _ := logfu.TruncateSerializerFac(logfu.FastJSONSerializerFac, 256)()
+	var buf bytes.Buffer
+	if err := s.Serialize(&buf, kv); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if buf.Len() > 256 || m["truncated"] != true || m["n"] != 42.0 || m["k"] != "short" {
+		t.Errorf("unexpected truncation (%v bytes): %s", buf.Len(), buf.Bytes())
+	}
+	if msg := m["msg"].(string); !utf8.ValidString(msg) || len(msg) < len(m["err"].(string)) || len(msg) < 100 {
+		t.Errorf("expected the longest value to be cut to the other's length, got %v and %v bytes",
+			len(msg), len(m["err"].(string)))
+	}
+
+	s, _ = logfu.TruncateSerializerFac(logfu.LogfmtSerializerFac, logfu.SyslogUDPRecordSize)()
+	buf.Reset()
+	s.Serialize(&buf, kv)
+	if buf.Len() > logfu.SyslogUDPRecordSize || !strings.HasSuffix(buf.String(), " truncated=true\n") {
+		t.Errorf("unexpected logfmt truncation (%v bytes): %q", buf.Len(), buf.String())
+	}
+
+	// times, the level and the timestamp are left whole
+	ts := time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC)
+	s, _ = logfu.TruncateSerializerFac(logfu.FastJSONSerializerFac, 150)()
+	buf.Reset()
+	err := s.Serialize(&buf, []interface{}{"ts", "2024-05-01T12:00:00.123456789Z", "level", "error",
+		"start", ts, "msg", long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if m["ts"] != "2024-05-01T12:00:00.123456789Z" || m["level"] != "error" ||
+		m["start"] != ts.Format(time.RFC3339Nano) || m["truncated"] != true {
+		t.Errorf("unexpected truncation (%v bytes): %s", buf.Len(), buf.Bytes())
+	}
+
+	// keys given to keep replace the level and timestamp
+	s, _ = logfu.TruncateSerializerFac(logfu.FastJSONSerializerFac, 150, "id")()
+	buf.Reset()
+	id := strings.Repeat("i", 80)
+	err = s.Serialize(&buf, []interface{}{"ts", strings.Repeat("t", 80), "id", id, "msg", long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = nil
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if m["id"] != id || len(m["ts"].(string)) == 80 || m["truncated"] != true {
+		t.Errorf("unexpected truncation (%v bytes): %s", buf.Len(), buf.Bytes())
+	}
+
+	// the level of the log func reaches a wrapped LevelSerializer
+	got := logAt(t, logfu.TruncateSerializerFac(logfu.GELFSerializerFac(logfu.GELFOpts{Host: "h"}), 400),
+		log2.ERROR, "msg", long)
+	if !strings.Contains(got, `"level":3`) || len(got) > 400 {
+		t.Errorf("unexpected truncated GELF record (%v bytes): %q", len(got), got)
+	}
+
+	// nothing to shorten
+	s, _ = logfu.TruncateSerializerFac(logfu.FastJSONSerializerFac, 10)()
+	if err := s.Serialize(io.Discard, []interface{}{"n", 123456789012}); err == nil {
+		t.Error("expected error for record that can't be shortened")
+	}
+}
@@ -0,0 +1,208 @@
+package logfu
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/msample/log2"
+)
+
+// TruncatedKey is the key of the true keyval TruncateSerializerFac
+// adds to records it shortened.
+const TruncatedKey = "truncated"
+
+// Record size limits for TruncateSerializerFac
+const (
+	// SyslogUDPRecordSize fits a record and the RFC 3164 header
+	// the syslog writers add in the 1024 byte RFC 3164 packet
+	// limit.
+	SyslogUDPRecordSize = 1024 - syslogHeaderSize
+
+	// UDPRecordSize is the largest IPv4 UDP payload.
+	UDPRecordSize = 65507
+)
+
+// syslogHeaderSize is the most the srslog formatter the syslog
+// writers use puts before a record, "<PRI> TIMESTAMP HOSTNAME
+// TAG[PID]: ", with an RFC 3339 timestamp, a host name of up to
+// syslogHostMax bytes (HOST_NAME_MAX on Linux) and a tag, the program
+// name, of up to syslogTagMax. It comes to 128.
+const (
+	syslogHostMax    = 64
+	syslogTagMax     = 20
+	syslogHeaderSize = len("<191> 2006-01-02T15:04:05-07:00 ") + syslogHostMax +
+		len(" ") + syslogTagMax + len("[4194304]: ")
+)
+
+// TruncateSerializerFac wraps the Serializers made by f so records
+// serialized to more than maxSize bytes are shortened, rather than
+// cut, keeping them valid JSON, logfmt etc. The longest string,
+// []byte and error values are cut first, at UTF-8 boundaries, down to
+// a common length that makes the record fit, and a TruncatedKey, true
+// keyval is added. Other values, e.g. times, and the values of the
+// keepKeys keys are never cut. keepKeys default to LevelKey and "ts".
+// If cutting every other value isn't enough the record isn't written
+// and an error is returned.
+//
+// Each record is written with one Write, so use it instead of
+// LimitWriterFac for datagram writers, e.g. with SyslogUDPRecordSize.
+func TruncateSerializerFac(f func() (Serializer, error), maxSize int, keepKeys ...string) func() (Serializer, error) {
+	if len(keepKeys) == 0 {
+		keepKeys = []string{LevelKey, "ts"}
+	}
+	keep := make(map[string]bool, len(keepKeys))
+	for _, k := range keepKeys {
+		keep[k] = true
+	}
+	return func() (Serializer, error) {
+		s, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return &truncSerializer{s: s, max: maxSize, keep: keep}, nil
+	}
+}
+
+type truncSerializer struct {
+	s    Serializer
+	max  int
+	keep map[string]bool // keys whose values are never cut
+}
+
+// byteWriter appends writes to a pooled buffer
+type byteWriter struct {
+	b *[]byte
+}
+
+func (o byteWriter) Write(p []byte) (int, error) {
+	*o.b = append(*o.b, p...)
+	return len(p), nil
+}
+
+func (o *truncSerializer) Serialize(w io.Writer, keyvals []interface{}) error {
+	return o.serialize(w, keyvals, o.s.Serialize)
+}
+
+// SerializeLevel passes the level on to the wrapped Serializer if it
+// is a LevelSerializer
+func (o *truncSerializer) SerializeLevel(level log2.Level, w io.Writer, keyvals []interface{}) error {
+	ls, ok := o.s.(LevelSerializer)
+	if !ok {
+		return o.Serialize(w, keyvals)
+	}
+	return o.serialize(w, keyvals, func(w io.Writer, keyvals []interface{}) error {
+		return ls.SerializeLevel(level, w, keyvals)
+	})
+}
+
+func (o *truncSerializer) serialize(w io.Writer, keyvals []interface{}, ser func(io.Writer, []interface{}) error) error {
+	bp := getBuf()
+	defer putBuf(bp)
+	*bp = (*bp)[:0]
+	bw := byteWriter{bp}
+	if err := ser(bw, keyvals); err != nil {
+		return err
+	}
+	if len(*bp) > o.max {
+		n := len(keyvals)
+		kv := make([]interface{}, n, n+3)
+		copy(kv, keyvals)
+		if n%2 == 1 {
+			kv = append(kv, missingValue)
+			n++
+		}
+		kv = append(kv, TruncatedKey, true)
+		// escaping means cutting n bytes of values saves at least
+		// n bytes of output, so this rarely takes more than two
+		// passes, the second for the marker
+		for try := 0; len(*bp) > o.max; try++ {
+			if try == 4 || !shrinkValues(kv[:n], len(*bp)-o.max, o.keep) {
+				return fmt.Errorf("truncate: record of %v bytes can't be shortened to %v", len(*bp), o.max)
+			}
+			*bp = (*bp)[:0]
+			if err := ser(bw, kv); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := w.Write(*bp)
+	return err
+}
+
+// shrinkValues cuts the longest string, []byte and error values in
+// keyvals, other than those of keep keys, down to a common length, by
+// at least need bytes in total if it can. It returns false if there
+// was nothing to cut.
+func shrinkValues(keyvals []interface{}, need int, keep map[string]bool) bool {
+	type val struct {
+		i int
+		s string
+	}
+	var vals []val
+	total := 0
+	for i := 1; i < len(keyvals); i += 2 {
+		if k, _ := keyvals[i-1].(string); keep[k] {
+			continue
+		}
+		var s string
+		switch x := keyvals[i].(type) {
+		case string:
+			s = x
+		case []byte:
+			s = string(x)
+		case error:
+			s = safeError(x)
+		default:
+			continue
+		}
+		if len(s) > 0 {
+			vals = append(vals, val{i, s})
+			total += len(s)
+		}
+	}
+	if total == 0 {
+		return false
+	}
+
+	// the largest length l such that cutting everything to l saves
+	// need bytes
+	cut := func(l int) int {
+		n := 0
+		for _, v := range vals {
+			if len(v.s) > l {
+				n += len(v.s) - l
+			}
+		}
+		return n
+	}
+	maxLen := 0
+	for _, v := range vals {
+		if len(v.s) > maxLen {
+			maxLen = len(v.s)
+		}
+	}
+	l := sort.Search(maxLen+1, func(l int) bool { return cut(l) < need }) - 1
+	if l < 0 {
+		l = 0
+	}
+	for _, v := range vals {
+		if len(v.s) > l {
+			keyvals[v.i] = truncUTF8(v.s, l)
+		}
+	}
+	return true
+}
+
+// truncUTF8 returns s cut to at most n bytes without splitting a
+// rune
+func truncUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
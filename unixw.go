@@ -0,0 +1,189 @@
+package logfu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Framing is how stream writers delimit records.
+type Framing int
+
+const (
+	// FrameNewline ends each record with exactly one newline.
+	FrameNewline Framing = iota
+
+	// FrameLengthPrefix precedes each record with its length as a
+	// 4 byte big-endian unsigned integer.
+	FrameLengthPrefix
+
+	// FrameJSONSeq writes RFC 7464 JSON text sequences: an ASCII
+	// RS before each record and a newline after it.
+	FrameJSONSeq
+)
+
+// ErrNoReader is returned by UnixWriter when nothing is listening on
+// the socket or has the FIFO open for reading. The record is dropped.
+var ErrNoReader = errors.New("no reader")
+
+// appendFrame appends record p framed per f
+func appendFrame(dst, p []byte, f Framing) []byte {
+	switch f {
+	case FrameLengthPrefix:
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(p)))
+		return append(dst, p...)
+	case FrameJSONSeq:
+		dst = append(dst, 0x1e)
+		return append(append(dst, trimNL(p)...), '\n')
+	}
+	return append(append(dst, trimNL(p)...), '\n')
+}
+
+// UnixOpts configures a UnixWriter.
+type UnixOpts struct {
+	// Framing delimits records. Each datagram holds one framed
+	// record.
+	Framing Framing
+
+	// ReconnectInterval is the least time between attempts to
+	// connect, or to open the FIFO, while the reader is
+	// absent. Records written in between are dropped. Defaults to
+	// 1s.
+	ReconnectInterval time.Duration
+
+	// WriteTimeout bounds each write, so a stalled reader can't
+	// block logging. Defaults to 1s.
+	WriteTimeout time.Duration
+}
+
+// UnixStreamWriterFac returns a WriterFac for a UnixWriter connected
+// to the unix stream socket at path.
+func UnixStreamWriterFac(path string, opts UnixOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewUnixWriter("unix", path, opts)
+	}
+}
+
+// UnixDatagramWriterFac returns a WriterFac for a UnixWriter sending
+// to the unix datagram socket at path.
+func UnixDatagramWriterFac(path string, opts UnixOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewUnixWriter("unixgram", path, opts)
+	}
+}
+
+// FIFOWriterFac returns a WriterFac for a UnixWriter writing to the
+// named pipe at path.
+func FIFOWriterFac(path string, opts UnixOpts) func() (io.Writer, error) {
+	return func() (io.Writer, error) {
+		return NewUnixWriter("fifo", path, opts)
+	}
+}
+
+// UnixWriter writes framed records to a unix stream or datagram
+// socket or a FIFO. It never waits for a reader: while the peer is
+// absent Write returns ErrNoReader, and it reconnects, at most every
+// ReconnectInterval, once the peer is back. A write that fails
+// closes the connection and is retried once on a new one. A stream
+// write that times out part way closes the connection too, so the
+// reader may see a truncated last record. Safe for concurrent use.
+type UnixWriter struct {
+	network  string
+	path     string
+	opts     UnixOpts
+	mutex    sync.Mutex
+	conn     deadlineWriter
+	lastDial time.Time
+	buf      []byte
+}
+
+type deadlineWriter interface {
+	io.WriteCloser
+	SetWriteDeadline(time.Time) error
+}
+
+// NewUnixWriter returns a UnixWriter for network "unix" (stream),
+// "unixgram" or "fifo". It tries to connect, but a missing reader
+// isn't an error.
+func NewUnixWriter(network, path string, opts UnixOpts) (*UnixWriter, error) {
+	switch network {
+	case "unix", "unixgram", "fifo":
+	default:
+		return nil, fmt.Errorf("unix writer: unknown network %q", network)
+	}
+	if opts.ReconnectInterval <= 0 {
+		opts.ReconnectInterval = time.Second
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = time.Second
+	}
+	rv := &UnixWriter{network: network, path: path, opts: opts}
+	rv.lastDial = time.Now()
+	rv.conn, _ = rv.dial()
+	return rv, nil
+}
+
+func (o *UnixWriter) dial() (deadlineWriter, error) {
+	if o.network == "fifo" {
+		// fails with ENXIO rather than blocking if there's no reader
+		return os.OpenFile(o.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	}
+	c, err := net.DialTimeout(o.network, o.path, o.opts.WriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (o *UnixWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.buf = appendFrame(o.buf[:0], p, o.opts.Framing)
+	for try := 0; try < 2; try++ {
+		if o.conn == nil {
+			if try == 0 && time.Since(o.lastDial) < o.opts.ReconnectInterval {
+				return 0, ErrNoReader
+			}
+			o.lastDial = time.Now()
+			c, err := o.dial()
+			if err != nil {
+				return 0, ErrNoReader
+			}
+			o.conn = c
+		}
+		o.conn.SetWriteDeadline(time.Now().Add(o.opts.WriteTimeout))
+		n, err := o.conn.Write(o.buf)
+		if err == nil {
+			return len(p), nil
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && (n == 0 || o.network == "unixgram") {
+			// the reader is slow; the stream is still in step
+			return 0, err
+		}
+		o.conn.Close()
+		o.conn = nil
+		if n > 0 {
+			return 0, err
+		}
+	}
+	return 0, ErrNoReader
+}
+
+func (o *UnixWriter) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.conn == nil {
+		return nil
+	}
+	err := o.conn.Close()
+	o.conn = nil
+	return err
+}
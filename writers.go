@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"unicode/utf8"
 
 	syslog "github.com/RackSec/srslog" // more standards compliant than log/sylog
 	"github.com/go-kit/kit/log"
@@ -118,6 +119,10 @@ func NewMultiWriterCloser(w ...io.Writer) *MultiWriterCloser {
 	return &MultiWriterCloser{io.MultiWriter(w...), w}
 }
 
+func (o *MultiWriterCloser) nested() []io.Writer {
+	return o.writers
+}
+
 func (o *MultiWriterCloser) Close() error {
 	var errs []error
 	for _, w := range o.writers {
@@ -134,18 +139,48 @@ func (o *MultiWriterCloser) Close() error {
 	return nil
 }
 
+// LimitWriter cuts writes longer than maxSize bytes, at a UTF-8
+// boundary and keeping a trailing newline. It reports len(p) written
+// as the cut is deliberate. A cut record won't parse as JSON etc, so
+// prefer TruncateSerializerFac, which shortens records before
+// serialization, and use this as a backstop.
 type LimitWriter struct {
 	maxSize int
 	w       io.Writer
 }
 
 func (w *LimitWriter) Write(p []byte) (n int, err error) {
-	if len(p) > w.maxSize {
-		return w.w.Write(p[:w.maxSize])
+	if len(p) <= w.maxSize {
+		return w.w.Write(p)
+	}
+	nl := p[len(p)-1] == '\n' && w.maxSize > 0
+	max := w.maxSize
+	if nl {
+		max--
+	}
+	for max > 0 && !utf8.RuneStart(p[max]) {
+		max--
+	}
+	if !nl {
+		_, err = w.w.Write(p[:max])
+	} else {
+		// one Write, for datagram writers
+		bp := getBuf()
+		*bp = append(append((*bp)[:0], p[:max]...), '\n')
+		_, err = w.w.Write(*bp)
+		putBuf(bp)
+	}
+	if err != nil {
+		return 0, err
 	}
-	return w.w.Write(p)
+	return len(p), nil
 }
 
+func (w *LimitWriter) nested() []io.Writer {
+	return []io.Writer{w.w}
+}
+
+// LimitWriterFac wraps the writers made by f with a LimitWriter.
 func LimitWriterFac(f func() (io.Writer, error), maxSizePerWrite int) func() (io.Writer, error) {
 	return func() (io.Writer, error) {
 		w, err := f()
@@ -161,24 +196,25 @@ type RSWriter struct {
 }
 
 func (r *RSWriter) Write(p []byte) (n int, err error) {
-	var i, j int
-	n, err = r.w.Write([]byte{10}) // LF
-	if err != nil {
-		return
+	bp := getBuf()
+	defer putBuf(bp)
+	*bp = appendFrame((*bp)[:0], p, FrameJSONSeq)
+	if _, err = r.w.Write(*bp); err != nil {
+		return 0, err
 	}
-	i, err = r.w.Write(p)
-	n += i
-	if err != nil {
-		return
-	}
-	j, err = r.w.Write([]byte{30}) // RS
-	n += j
-	return
+	return len(p), nil
+}
+
+func (r *RSWriter) nested() []io.Writer {
+	return []io.Writer{r.w}
 }
 
-// Wraps the given Writer to an add an ascii RS (record separator)
-// before each write and an LF after.  Useful for producing json-seq
-// when each individual write to the wrapped writer is a JSON value.
+// Wraps the given Writer to write RFC 7464 JSON text sequences
+// (json-seq): an ascii RS (record separator) before each write and an
+// LF after, replacing a trailing LF from the serializer, in a single
+// Write to the wrapped writer.  Useful when each individual write to
+// the wrapped writer is a JSON value.  lfuread.JSONSeqReader reads
+// them back.
 func RSWriterFac(f func() (io.Writer, error)) func() (io.Writer, error) {
 	return func() (io.Writer, error) {
 		w, err := f()
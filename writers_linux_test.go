@@ -0,0 +1,150 @@
+package logfu_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/msample/log2"
+	"github.com/msample/logfu"
+)
+
+func TestJournaldWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	w, err := logfu.NewJournaldWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s, _ := logfu.JournaldSerializerFac(logfu.JournaldOpts{Identifier: "app"})()
+
+	buf := make([]byte, 64<<10)
+	oob := make([]byte, 64)
+	if err := s.Serialize(w, []interface{}{"level", "error", "msg", "boom"}); err != nil {
+		t.Fatal(err)
+	}
+	n, _, _, _, err := l.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "LEVEL=error\nMESSAGE=boom\nPRIORITY=3\nSYSLOG_IDENTIFIER=app\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// too big for a datagram, so sent as a file descriptor
+	big := bytes.Repeat([]byte("x"), 4<<20)
+	if err := s.Serialize(w, []interface{}{"msg", string(big)}); err != nil {
+		t.Fatal(err)
+	}
+	n, oobn, _, _, err := l.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected empty datagram with fd, got %v bytes", n)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected one control message: %v", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("expected one fd: %v", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "journal")
+	defer f.Close()
+	f.Seek(0, io.SeekStart)
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("MESSAGE=xxx")) || len(data) != len(big)+len("MESSAGE=\nPRIORITY=6\nSYSLOG_IDENTIFIER=app\n") {
+		t.Errorf("unexpected fd contents, %v bytes", len(data))
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("expected sealed memfd to be read only")
+	}
+}
+
+func TestFIFOWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := logfu.NewUnixWriter("fifo", path, logfu.UnixOpts{ReconnectInterval: 10 * time.Millisecond})
+	defer w.Close()
+	if _, err := w.Write([]byte("x")); err != logfu.ErrNoReader {
+		t.Fatalf("expected ErrNoReader, got %v", err)
+	}
+
+	r, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := w.Write([]byte("msg=hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := r.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "msg=hi\n" {
+		t.Errorf("unexpected record %q", got)
+	}
+}
+
+func TestDumpSignal(t *testing.T) {
+	ch := make(chan string, 1)
+	lf, err := logfu.New(
+		[]logfu.FiltererFac{logfu.IdentityFilterFac},
+		[]logfu.SerializerFac{logfu.LogfmtSerializerFac},
+		[]logfu.WriterFac{logfu.RingWriterFac(logfu.RingOpts{
+			DumpTo: func() (io.Writer, error) { return chanWriter(ch), nil },
+		})},
+		[]logfu.Mode{{log2.DEBUG: []logfu.Fsw{{0, 0, 0}}}},
+		false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lf.ChangeToMode(0, true, true); err != nil {
+		t.Fatal(err)
+	}
+	defer log2.Swap(log2.DEBUG, nil)
+	lf.SetDumpSignal(syscall.SIGWINCH)
+	lf.SignalControlOn()
+	defer lf.SignalControlOff()
+
+	log2.Debug("msg", "held")
+	syscall.Kill(os.Getpid(), syscall.SIGWINCH)
+	select {
+	case got := <-ch:
+		if got != "msg=held\n" {
+			t.Errorf("unexpected dump %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no dump on signal")
+	}
+}
+
+type chanWriter chan string
+
+func (o chanWriter) Write(p []byte) (int, error) {
+	o <- string(p)
+	return len(p), nil
+}
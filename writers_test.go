@@ -0,0 +1,679 @@
+package logfu_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/msample/log2"
+	"github.com/msample/logfu"
+)
+
+func TestGELFUDPWriter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	w, err := logfu.GELFUDPWriterFac(pc.LocalAddr().String(), logfu.GELFGzip, 100)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+
+	// incompressible enough to need several chunks
+	var sb strings.Builder
+	for i := 0; sb.Len() < 2000; i++ {
+		sb.WriteString(time.Duration(i * 7919).String())
+	}
+	msg := `{"short_message":"` + sb.String() + `"}`
+	if n, err := w.Write([]byte(msg)); err != nil || n != len(msg) {
+		t.Fatalf("write: %v %v", n, err)
+	}
+
+	var chunks [][]byte
+	count := -1
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for count < 0 || len(chunks) < count {
+		b := make([]byte, 200)
+		n, _, err := pc.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 100 || b[0] != 0x1e || b[1] != 0x0f {
+			t.Fatalf("bad chunk: %v bytes % x", n, b[:2])
+		}
+		count = int(b[11])
+		chunks = append(chunks, b[:n])
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i][10] < chunks[j][10] })
+	var z bytes.Buffer
+	for _, c := range chunks {
+		z.Write(c[12:])
+	}
+	zr, err := gzip.NewReader(&z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(zr)
+	if string(got) != msg {
+		t.Errorf("reassembled message differs: %q", got)
+	}
+}
+
+func TestGELFTCPWriter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			s, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+			got <- s
+		}
+	}()
+
+	w, err := logfu.GELFTCPWriterFac(l.Addr().String())()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+	w.Write([]byte(`{"a":1}`))
+	w.Write([]byte(`{"b":2}`))
+	for _, want := range []string{"{\"a\":1}\x00", "{\"b\":2}\x00"} {
+		select {
+		case s := <-got:
+			if s != want {
+				t.Errorf("got %q want %q", s, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out")
+		}
+	}
+}
+
+func TestOTLPHTTPWriter(t *testing.T) {
+	reqs := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		reqs <- b
+	}))
+	defer srv.Close()
+
+	s, _ := logfu.OTLPSerializerFac(logfu.OTLPOpts{Resource: map[string]interface{}{"service.name": "a"}})()
+	w, err := logfu.NewOTLPHTTPWriter(logfu.OTLPHTTPOpts{
+		URL:           srv.URL,
+		Headers:       map[string]string{"Authorization": "Bearer tok"},
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := s.Serialize(w, []interface{}{"msg", "m", "i", i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(b []byte) int {
+		var req struct {
+			ResourceLogs []struct {
+				ScopeLogs []struct{ LogRecords []json.RawMessage }
+			}
+		}
+		if err := json.Unmarshal(b, &req); err != nil {
+			t.Fatalf("%v: %s", err, b)
+		}
+		if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 1 {
+			t.Fatalf("records not merged: %s", b)
+		}
+		return len(req.ResourceLogs[0].ScopeLogs[0].LogRecords)
+	}
+	if n := count(<-reqs); n != 3 {
+		t.Errorf("expected a batch of 3, got %v", n)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(<-reqs); n != 1 {
+		t.Errorf("expected 1 record drained on close, got %v", n)
+	}
+
+	w, _ = logfu.NewOTLPHTTPWriter(logfu.OTLPHTTPOpts{URL: srv.URL, BatchSize: 1})
+	defer w.Close()
+	s.Serialize(w, []interface{}{"msg", "m"})
+	if err := w.Flush(); err == nil {
+		t.Error("expected error for rejected batch")
+	}
+	for _, rec := range []string{"not json\n", `{"resourceLogs":[` + "\n", `{"msg":"m"}` + "\n"} {
+		if _, err := w.Write([]byte(rec)); err == nil {
+			t.Errorf("expected error for non-OTLP record %q", rec)
+		}
+	}
+}
+
+func TestHTTPWriter(t *testing.T) {
+	type req struct {
+		hdr  http.Header
+		body string
+	}
+	reqs := make(chan req, 10)
+	fails := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails > 0 {
+			fails--
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		if strings.Contains(string(b), "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		reqs <- req{r.Header, string(b)}
+	}))
+	defer srv.Close()
+
+	w, err := logfu.NewHTTPWriter(logfu.HTTPOpts{
+		URL:        srv.URL,
+		Headers:    map[string]string{"X-Token": "tok"},
+		MaxRecords: 2,
+		MaxLatency: 50 * time.Millisecond,
+		Gzip:       true,
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("{\"n\":1}\n"))
+	w.Write([]byte("{\"n\":2}\n"))
+	r := <-reqs
+	if r.body != "{\"n\":1}\n{\"n\":2}\n" || r.hdr.Get("X-Token") != "tok" ||
+		r.hdr.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("unexpected request %v %q", r.hdr, r.body)
+	}
+	if fails != 0 {
+		t.Errorf("expected the 503s to be retried")
+	}
+
+	// sent by latency
+	w.Write([]byte("{\"n\":3}\n"))
+	select {
+	case r = <-reqs:
+		if r.body != "{\"n\":3}\n" {
+			t.Errorf("unexpected body %q", r.body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch not sent after MaxLatency")
+	}
+
+	w.Write([]byte("reject\n"))
+	if err := w.Flush(); err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("expected error for 400 status, got %v", err)
+	}
+	<-reqs
+	if n := w.Dropped(); n != 1 {
+		t.Errorf("expected 1 dropped record, got %v", n)
+	}
+
+	// drained on close
+	w.Write([]byte("{\"n\":4}\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r = <-reqs; r.body != "{\"n\":4}\n" {
+		t.Errorf("unexpected body %q", r.body)
+	}
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("expected error writing after close")
+	}
+}
+
+func TestHTTPFramings(t *testing.T) {
+	ts := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	recs := []logfu.HTTPRecord{{ts, []byte("{\"msg\":\"a\"}\n")}, {ts, []byte("msg=b\n")}}
+	for _, c := range []struct {
+		f    logfu.HTTPFraming
+		want string
+	}{
+		{logfu.ESBulkFraming("logs"),
+			"{\"create\":{\"_index\":\"logs\"}}\n{\"msg\":\"a\"}\n{\"create\":{\"_index\":\"logs\"}}\nmsg=b\n"},
+		{logfu.SplunkHECFraming(logfu.SplunkHECOpts{SourceType: "_json"}),
+			"{\"time\":1792317600.000,\"sourcetype\":\"_json\",\"event\":{\"msg\":\"a\"}}\n" +
+				"{\"time\":1792317600.000,\"sourcetype\":\"_json\",\"event\":\"msg=b\"}\n"},
+		{logfu.LokiFraming(map[string]string{"job": "app", "env": "prod"}),
+			`{"streams":[{"stream":{"env":"prod","job":"app"},"values":[["1792317600000000000","{\"msg\":\"a\"}"],` +
+				`["1792317600000000000","msg=b"]]}]}`},
+	} {
+		b, err := c.f.AppendBody(nil, recs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.want {
+			t.Errorf("got:\n%s\nwant:\n%s", b, c.want)
+		}
+	}
+
+	c := logfu.ESBulkFraming("").(logfu.HTTPResponseChecker)
+	if err := c.CheckResponse([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`)); err != nil {
+		t.Error(err)
+	}
+	err := c.CheckResponse([]byte(`{"errors":true,"items":[{"create":{"status":201}},` +
+		`{"create":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`))
+	var pe *logfu.PartialBatchError
+	if !errors.As(err, &pe) || pe.Failed != 1 || pe.Total != 2 {
+		t.Errorf("expected partial failure error, got %v", err)
+	}
+}
+
+func TestHTTPWriterDrops(t *testing.T) {
+	// Elasticsearch keeps the items that didn't fail
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"errors":true,"items":[{"create":{"status":201}},{"create":{"status":400}},{"create":{"status":201}}]}`)
+	}))
+	defer srv.Close()
+	w, _ := logfu.NewHTTPWriter(logfu.HTTPOpts{URL: srv.URL, Framing: logfu.ESBulkFraming("")})
+	for i := 0; i < 3; i++ {
+		w.Write([]byte("{}\n"))
+	}
+	if err := w.Flush(); err == nil || w.Dropped() != 1 {
+		t.Errorf("expected 1 dropped record, got %v: %v", w.Dropped(), err)
+	}
+	w.Close()
+
+	// Retry-After is capped by MaxBackoff and Close gives up after
+	// CloseTimeout
+	hang := make(chan struct{})
+	tries := 0
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tries++; tries < 3 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv2.Close()
+	defer close(hang)
+	w, _ = logfu.NewHTTPWriter(logfu.HTTPOpts{
+		URL:          srv2.URL,
+		MaxBackoff:   10 * time.Millisecond,
+		CloseTimeout: 200 * time.Millisecond,
+	})
+	w.Write([]byte("{\"n\":1}\n"))
+	w.Write([]byte("{\"n\":2}\n"))
+	start := time.Now()
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "CloseTimeout") {
+		t.Errorf("expected close timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	if n := w.Dropped(); n != 2 {
+		t.Errorf("expected 2 dropped records, got %v", n)
+	}
+}
+
+func TestHTTPWriterCloseFullQueue(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(hang)
+	w, _ := logfu.NewHTTPWriter(logfu.HTTPOpts{
+		URL:          srv.URL,
+		MaxRecords:   2,
+		QueueSize:    1,
+		CloseTimeout: 100 * time.Millisecond,
+	})
+
+	// one batch in flight, one waiting and the Write shipping a
+	// third blocks
+	wrote := make(chan struct{})
+	go func() {
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("{}\n"))
+		}
+		close(wrote)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// other Writes aren't held up by the blocked one
+	done := make(chan struct{})
+	go func() {
+		w.Write([]byte("{}\n"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Write held up by another Write waiting for the queue")
+	}
+
+	start := time.Now()
+	w.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v with a CloseTimeout of 100ms", d)
+	}
+	select {
+	case <-wrote:
+	case <-time.After(time.Second):
+		t.Fatal("blocked Write not released by Close")
+	}
+	if n := w.Dropped(); n != 7 {
+		t.Errorf("expected 7 dropped records, got %v", n)
+	}
+}
+
+func TestUnixStreamWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	w, err := logfu.NewUnixWriter("unix", path, logfu.UnixOpts{
+		Framing:           logfu.FrameLengthPrefix,
+		ReconnectInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("x\n")); err != logfu.ErrNoReader {
+		t.Fatalf("expected ErrNoReader, got %v", err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := w.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "\x00\x00\x00\x06hello\n" {
+		t.Errorf("unexpected frame %q", buf)
+	}
+
+	// reader restarts
+	c.Close()
+	l.Close()
+	for i := 0; i < 3; i++ {
+		w.Write([]byte("lost\n"))
+	}
+	l, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	time.Sleep(20 * time.Millisecond)
+	if _, err := w.Write([]byte("back\n")); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf = make([]byte, 9)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "\x00\x00\x00\x05back\n" {
+		t.Errorf("unexpected frame %q", buf)
+	}
+}
+
+func TestUnixDatagramWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "d.sock")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w, _ := logfu.NewUnixWriter("unixgram", path, logfu.UnixOpts{Framing: logfu.FrameJSONSeq})
+	defer w.Close()
+	if _, err := w.Write([]byte(`{"a":1}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "\x1e{\"a\":1}\n" {
+		t.Errorf("unexpected datagram %q", got)
+	}
+}
+
+// flakyWriter records writes and fails while broken
+type flakyWriter struct {
+	mutex  sync.Mutex
+	broken bool
+	buf    bytes.Buffer
+}
+
+func (o *flakyWriter) Write(p []byte) (int, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.broken {
+		return 0, errors.New("broken")
+	}
+	return o.buf.Write(p)
+}
+
+func (o *flakyWriter) Probe() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.broken {
+		return errors.New("still broken")
+	}
+	return nil
+}
+
+func (o *flakyWriter) set(broken bool) {
+	o.mutex.Lock()
+	o.broken = broken
+	o.mutex.Unlock()
+}
+
+func (o *flakyWriter) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buf.String()
+}
+
+func TestFailoverWriter(t *testing.T) {
+	a, b := &flakyWriter{}, &flakyWriter{}
+	changes := make(chan int, 10)
+	wf := logfu.FailoverWriterFac(logfu.HealthOpts{
+		ProbeInterval: 10 * time.Millisecond,
+		OnChange: func(i int, err error) {
+			if err == nil {
+				changes <- i
+			}
+		},
+	}, func() (io.Writer, error) { return a, nil }, func() (io.Writer, error) { return b, nil })
+	w, err := wf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw := w.(*logfu.FailoverWriter)
+	defer fw.Close()
+
+	fw.Write([]byte("1\n"))
+	a.set(true)
+	if _, err := fw.Write([]byte("2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if fw.Active() != 1 {
+		t.Errorf("expected failover to writer 1, active %v", fw.Active())
+	}
+	b.set(true)
+	if _, err := fw.Write([]byte("3\n")); err == nil {
+		t.Error("expected error with no healthy writer")
+	}
+	if fw.Active() != -1 {
+		t.Errorf("expected no active writer, got %v", fw.Active())
+	}
+
+	a.set(false)
+	select {
+	case i := <-changes:
+		if i != 0 {
+			t.Errorf("expected writer 0 to recover, got %v", i)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("primary not probed")
+	}
+	fw.Write([]byte("4\n"))
+	if a.String() != "1\n4\n" || b.String() != "2\n" {
+		t.Errorf("unexpected writes: %q %q", a.String(), b.String())
+	}
+}
+
+func TestFanoutWriter(t *testing.T) {
+	a, b := &flakyWriter{}, &flakyWriter{}
+	wf := logfu.FanoutWriterFac(logfu.HealthOpts{ProbeInterval: time.Hour},
+		func() (io.Writer, error) { return a, nil },
+		func() (io.Writer, error) { return nil, errors.New("no sink") },
+		func() (io.Writer, error) { return b, nil })
+	w, err := wf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.(io.Closer).Close()
+
+	n, err := w.Write([]byte("1\n"))
+	var pe *logfu.PartialWriteError
+	if n != 2 || !errors.As(err, &pe) || pe.Errs[0] != nil || pe.Errs[1] == nil || pe.Errs[2] != nil {
+		t.Errorf("expected partial failure of writer 1, got %v %v", n, err)
+	}
+	b.set(true)
+	w.Write([]byte("2\n"))
+	b.set(false)
+	w.Write([]byte("3\n"))
+	if a.String() != "1\n2\n3\n" || b.String() != "1\n" {
+		t.Errorf("unexpected writes: %q %q", a.String(), b.String())
+	}
+	a.set(true)
+	if n, err := w.Write([]byte("4\n")); n != 0 || err == nil {
+		t.Errorf("expected total failure, got %v %v", n, err)
+	}
+}
+
+func TestRingWriter(t *testing.T) {
+	var dump bytes.Buffer
+	w := logfu.NewRingWriter(logfu.RingOpts{
+		MaxRecords: 3,
+		MaxBytes:   20,
+		DumpTo:     func() (io.Writer, error) { return &dump, nil },
+	})
+	for _, r := range []string{"a=1\n", "a=2\n", "a=3\n", "a=4\n"} {
+		w.Write([]byte(r))
+	}
+	if w.Len() != 3 {
+		t.Errorf("expected 3 records, got %v", w.Len())
+	}
+	w.Write([]byte("long=123456789012\n")) // leaves room for no others
+	if err := w.Dump(); err != nil {
+		t.Fatal(err)
+	}
+	if got := dump.String(); got != "long=123456789012\n" {
+		t.Errorf("unexpected dump %q", got)
+	}
+	dump.Reset()
+	w.Write([]byte("a=5\n"))
+	w.Write([]byte("a=6\n"))
+	w.Dump()
+	if got := dump.String(); got != "a=5\na=6\n" || w.Len() != 0 {
+		t.Errorf("unexpected dump %q", got)
+	}
+}
+
+func TestRingWriterTrigger(t *testing.T) {
+	var dump bytes.Buffer
+	w := logfu.NewRingWriter(logfu.RingOpts{
+		DumpTo:        func() (io.Writer, error) { return &dump, nil },
+		TriggerLevels: []log2.Level{log2.ERROR},
+		TriggerOnce:   true,
+	})
+	w.WriteLevel(log2.DEBUG, []byte("level=debug msg=\"level=error\"\n"))
+	w.Write([]byte("level=error msg=\"no level given\"\n"))
+	w.WriteLevel(log2.INFO, []byte(`{"level":"info"}`+"\n"))
+	if dump.Len() != 0 {
+		t.Fatalf("unexpected dump %q", dump.String())
+	}
+	w.WriteLevel(log2.ERROR, []byte(`{"msg":"boom"}`+"\n"))
+	want := "level=debug msg=\"level=error\"\nlevel=error msg=\"no level given\"\n{\"level\":\"info\"}\n{\"msg\":\"boom\"}\n"
+	if got := dump.String(); got != want {
+		t.Errorf("got:\n%q\nwant:\n%q", got, want)
+	}
+	dump.Reset()
+	w.WriteLevel(log2.ERROR, []byte("msg=again\n"))
+	if dump.Len() != 0 || w.Len() != 1 {
+		t.Errorf("expected TriggerOnce to stop dumps, got %q", dump.String())
+	}
+}
+
+func TestLimitWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := logfu.LimitWriterFac(func() (io.Writer, error) { return &buf, nil }, 6)()
+	if n, err := w.Write([]byte("ab€€\n")); n != 9 || err != nil {
+		t.Errorf("expected 9, nil, got %v %v", n, err)
+	}
+	if got := buf.String(); got != "ab€\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+	buf.Reset()
+	w.Write([]byte("short\n"))
+	if got := buf.String(); got != "short\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+}